@@ -0,0 +1,239 @@
+package api
+
+import (
+	"harmony/backend/cache"
+	"harmony/backend/handlers"
+	"harmony/backend/hub"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminMiddleware only lets through signed-in devices of admins. It has to
+// come after AuthMiddleware; personal access tokens never get here, since
+// the admin routes aren't in tokenScopes.
+func AdminMiddleware(admins []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := handlers.GetUser(c.Request.Context(), c.GetString("user_id"))
+		if err != nil {
+			abortInternal(c, "getting user", err)
+			return
+		}
+
+		if !slices.Contains(admins, strings.ToLower(user.Email)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, nil)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// targetUser checks the user an admin route acts on exists, responding
+// with 404 otherwise.
+func targetUser(c *gin.Context) (string, bool) {
+	uid := c.Param("id")
+	_, err := handlers.GetUser(c.Request.Context(), uid)
+	if err == handlers.ErrNoUser {
+		c.String(http.StatusNotFound, "[error] user not found")
+		return "", false
+	} else if err != nil {
+		internalError(c, "getting user", err)
+		return "", false
+	}
+	return uid, true
+}
+
+// setupAdmin registers the endpoints operators manage accounts with. They
+// are only there when admins, which are lower case, names someone.
+func setupAdmin(r *gin.Engine, admins []string) {
+	if len(admins) == 0 {
+		return
+	}
+	slog.Info("admin API enabled", "admins", admins)
+
+	admin := r.Group("/admin", AdminMiddleware(admins))
+
+	admin.GET("/users", func(c *gin.Context) {
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.String(http.StatusBadRequest, "invalid offset")
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+		if err != nil || limit < 1 || limit > maxPageSize {
+			c.String(http.StatusBadRequest, "invalid limit")
+			return
+		}
+
+		users, total, err := handlers.ListUsers(c.Request.Context(), offset, limit)
+		if err != nil {
+			internalError(c, "listing users", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"total":  total,
+			"offset": offset,
+			"limit":  limit,
+			"items":  users,
+		})
+	})
+
+	admin.GET("/users/:id", func(c *gin.Context) {
+		user, err := handlers.GetUserSummary(c.Request.Context(), c.Param("id"))
+		if err == handlers.ErrNoUser {
+			c.String(http.StatusNotFound, "[error] user not found")
+			return
+		} else if err != nil {
+			internalError(c, "getting user", err)
+			return
+		}
+
+		quota, err := handlers.GetQuota(c.Request.Context(), user.Id)
+		if err != nil {
+			internalError(c, "getting quota", err)
+			return
+		}
+
+		usage, err := handlers.GetUsage(c.Request.Context(), user.Id)
+		if err != nil {
+			internalError(c, "getting usage", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"user": user, "quota": quota, "usage": usage})
+	})
+
+	admin.PUT("/users/:id", func(c *gin.Context) {
+		var body struct {
+			Disabled *bool `json:"disabled"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.Disabled == nil {
+			c.String(http.StatusBadRequest, "invalid user")
+			return
+		}
+
+		if *body.Disabled && c.Param("id") == c.GetString("user_id") {
+			c.String(http.StatusBadRequest, "can't disable your own account")
+			return
+		}
+
+		err := handlers.SetUserDisabled(c.Request.Context(), c.Param("id"), *body.Disabled)
+		if err == handlers.ErrNoUser {
+			c.String(http.StatusNotFound, "[error] user not found")
+			return
+		} else if err != nil {
+			internalError(c, "updating user", err)
+			return
+		}
+		slog.InfoContext(c.Request.Context(), "admin updated user", "admin", c.GetString("email"), "target", c.Param("id"), "disabled", *body.Disabled)
+
+		c.String(http.StatusOK, "")
+	})
+
+	admin.DELETE("/users/:id", func(c *gin.Context) {
+		uid := c.Param("id")
+		if uid == c.GetString("user_id") {
+			c.String(http.StatusBadRequest, "can't delete your own account")
+			return
+		}
+
+		err := handlers.DeleteUser(c.Request.Context(), uid)
+		if err == handlers.ErrNoUser {
+			c.String(http.StatusNotFound, "[error] user not found")
+			return
+		} else if err != nil {
+			internalError(c, "deleting user", err)
+			return
+		}
+
+		// connected devices notice they're signed out on their next check
+		hub.Publish(uid, hub.Event{Action: hub.Cleared})
+		slog.InfoContext(c.Request.Context(), "admin deleted user", "admin", c.GetString("email"), "target", uid)
+
+		c.String(http.StatusOK, "")
+	})
+
+	// Quotas left out or null fall back to the defaults.
+	admin.PUT("/users/:id/quota", func(c *gin.Context) {
+		uid, ok := targetUser(c)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Storage     *int64 `json:"storage"`
+			Clips       *int64 `json:"clips"`
+			DailyUpload *int64 `json:"daily_upload"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "invalid quota")
+			return
+		}
+
+		for _, q := range []*int64{body.Storage, body.Clips, body.DailyUpload} {
+			if q != nil && *q < 0 {
+				c.String(http.StatusBadRequest, "quotas must not be negative")
+				return
+			}
+		}
+
+		if err := handlers.SetQuota(c.Request.Context(), uid, body.Storage, body.Clips, body.DailyUpload); err != nil {
+			internalError(c, "setting quota", err)
+			return
+		}
+
+		quota, err := handlers.GetQuota(c.Request.Context(), uid)
+		if err != nil {
+			internalError(c, "getting quota", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, quota)
+	})
+
+	admin.DELETE("/users/:id/buffers", func(c *gin.Context) {
+		uid, ok := targetUser(c)
+		if !ok {
+			return
+		}
+
+		n, version, err := handlers.ClearBuffers(c.Request.Context(), uid)
+		if err != nil {
+			internalError(c, "clearing buffers", err)
+			return
+		}
+
+		cache.Set(c.Request.Context(), uid, version)
+		hub.Publish(uid, hub.Event{Action: hub.Cleared, Version: version})
+		slog.InfoContext(c.Request.Context(), "admin purged clips", "admin", c.GetString("email"), "target", uid, "deleted", n)
+
+		c.JSON(http.StatusOK, gin.H{"deleted": n})
+	})
+
+	// Force-revokes everything the user is signed in with: their devices'
+	// sessions, their personal access tokens and their devices' client
+	// certificates.
+	admin.DELETE("/users/:id/sessions", func(c *gin.Context) {
+		uid, ok := targetUser(c)
+		if !ok {
+			return
+		}
+
+		r, err := handlers.RevokeUserAccess(c.Request.Context(), uid)
+		if err != nil {
+			internalError(c, "revoking access", err)
+			return
+		}
+		slog.InfoContext(c.Request.Context(), "admin revoked access", "admin", c.GetString("email"), "target", uid,
+			"sessions", r.Sessions, "tokens", r.Tokens, "certificates", r.Certificates)
+
+		c.JSON(http.StatusOK, r)
+	})
+}
@@ -1,22 +1,53 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"harmony/backend/cache"
+	"harmony/backend/common"
+	"harmony/backend/config"
 	"harmony/backend/handlers"
+	"harmony/backend/hub"
+	"harmony/backend/identity"
+	"harmony/backend/logging"
+	"harmony/backend/metrics"
 	"harmony/backend/utils"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
-	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	maxWait         = 60 // seconds
+)
+
+// AuthMiddleware lets through requests from signed-in devices, which carry
+// an access token cookie or present the client certificate pinned to them,
+// and from scripts using a personal access token as a bearer token.
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if secret, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			tokenAuth(c, secret)
+			return
+		}
+
 		token, err := c.Cookie("access_token")
 		if err != nil {
+			if fp := clientCertFingerprint(c.Request); fp != "" {
+				certAuth(c, fp)
+				return
+			}
 			c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
 			return
 		}
@@ -29,43 +60,390 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		uid, _ := claims["user_id"].(string)
 		email, _ := claims["email"].(string)
+		did, _ := claims["device_id"].(string)
+		sid, _ := claims["session_id"].(string)
+
+		err = handlers.CheckUser(c.Request.Context(), uid)
+		if err == handlers.ErrNoUser || err == handlers.ErrUserDisabled {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+			return
+		} else if err != nil {
+			abortInternal(c, "checking user", err)
+			return
+		}
+
+		err = handlers.CheckDevice(c.Request.Context(), uid, did)
+		if err == handlers.ErrNoDevice || err == handlers.ErrDeviceRevoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+			return
+		} else if err != nil {
+			abortInternal(c, "checking device", err)
+			return
+		}
+
+		// tokens issued before sessions existed have none, and are let
+		// through until they expire
+		if sid != "" {
+			err = handlers.CheckSession(c.Request.Context(), sid)
+			if err == handlers.ErrNoSession || err == handlers.ErrSessionRevoked {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+				return
+			} else if err != nil {
+				abortInternal(c, "checking session", err)
+				return
+			}
+		}
 
 		c.Set("user_id", uid)
+		c.Request = c.Request.WithContext(logging.WithUserID(c.Request.Context(), uid))
 		c.Set("email", email)
+		c.Set("device_id", did)
+		c.Set("session_id", sid)
 		c.Next()
 	}
 }
 
-func Setup() {
-	r := gin.Default()
+// internalError logs err with what the server was doing, and responds with
+// a 500 saying only the latter.
+func internalError(c *gin.Context, doing string, err error) {
+	slog.ErrorContext(c.Request.Context(), doing, "error", err)
+	c.String(http.StatusInternalServerError, "[error] "+doing)
+}
+
+// abortInternal is internalError for middleware.
+func abortInternal(c *gin.Context, doing string, err error) {
+	slog.ErrorContext(c.Request.Context(), doing, "error", err)
+	c.AbortWithStatusJSON(http.StatusInternalServerError, nil)
+}
+
+// checkSignIn fails once the device, session or personal access token a
+// request was authenticated with has been revoked, or the user disabled,
+// for connections that outlive the request.
+func checkSignIn(c *gin.Context) error {
+	if err := handlers.CheckUser(c.Request.Context(), c.GetString("user_id")); err != nil {
+		return err
+	}
+
+	if tid := c.GetString("token_id"); tid != "" {
+		return handlers.CheckTokenById(c.Request.Context(), tid)
+	}
+
+	err := handlers.CheckDevice(c.Request.Context(), c.GetString("user_id"), c.GetString("device_id"))
+	if err != nil {
+		return err
+	}
+
+	if sid := c.GetString("session_id"); sid != "" {
+		return handlers.CheckSession(c.Request.Context(), sid)
+	}
+	return nil
+}
+
+var encryptionRegex = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+// parseClipType normalizes a clip's MIME type and checks it against the
+// allowlist.
+func parseClipType(s string) (handlers.BufType, error) {
+	mt, params, err := mime.ParseMediaType(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid type %q", s)
+	}
+
+	if !slices.Contains(common.ClipTypes, mt) {
+		return "", fmt.Errorf("type %s is not allowed", mt)
+	}
+
+	return handlers.BufType(mime.FormatMediaType(mt, params)), nil
+}
+
+// inlineTypes lists the clip types browsers may display. Anything else, like
+// HTML or SVG that could run script on the API's origin, is only served as
+// a download.
+var inlineTypes = []string{
+	"text/plain",
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/bmp",
+}
+
+// writeBuffer serves a clip. Content-Type reflects what the clip holds once
+// decrypted; X-Buffer-Encryption tells clients the body is ciphertext.
+// Clips are whatever users uploaded, so browsers are kept from sniffing
+// them or running anything in them.
+func writeBuffer(c *gin.Context, buf *handlers.Buffer) {
+	if buf.Encryption != "" {
+		c.Header("X-Buffer-Encryption", buf.Encryption)
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox")
+	if mt, _, err := mime.ParseMediaType(string(buf.Type)); err != nil || !slices.Contains(inlineTypes, mt) {
+		c.Header("Content-Disposition", "attachment")
+	}
+	c.Header("X-Buffer-Version", strconv.FormatInt(buf.Version, 10))
+	c.Header("X-Buffer-TTL", strconv.FormatInt(buf.Ttl, 10))
+	c.Data(http.StatusOK, string(buf.Type), buf.Data)
+}
+
+// checkLifetime validates a clip lifetime in seconds against the server's
+// bounds.
+func checkLifetime(seconds int64) (time.Duration, error) {
+	lifetime := time.Duration(seconds) * time.Second
+	if lifetime < common.MinLifetime || lifetime > common.MaxLifetime {
+		return 0, fmt.Errorf("lifetime must be between %d and %d seconds",
+			int64(common.MinLifetime.Seconds()), int64(common.MaxLifetime.Seconds()))
+	}
+	return lifetime, nil
+}
+
+var hashRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// readPayload reads a clip's payload from the request body. Payloads over
+// MaxUploadSize or the user's remaining quota are turned away before any of
+// them is read when Content-Length gives them away, and cut off once they
+// get there otherwise.
+func readPayload(c *gin.Context, uid string) ([]byte, bool) {
+	if n := c.Request.ContentLength; n > common.MaxUploadSize {
+		c.String(http.StatusRequestEntityTooLarge, "payload must be at most %d bytes", common.MaxUploadSize)
+		return nil, false
+	} else if n > 0 {
+		err := handlers.CheckUploadQuota(c.Request.Context(), uid, n)
+		if quotaExceeded(c, err) {
+			return nil, false
+		} else if err != nil {
+			internalError(c, "checking quota", err)
+			return nil, false
+		}
+	}
+
+	limit := int64(common.MaxUploadSize)
+	allowance, err := handlers.UploadAllowance(c.Request.Context(), uid)
+	if err != nil {
+		internalError(c, "checking quota", err)
+		return nil, false
+	}
+	if allowance >= 0 && allowance < limit {
+		limit = allowance
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		if limit < common.MaxUploadSize {
+			c.String(http.StatusRequestEntityTooLarge, "payload would go over your quota, %d bytes are left", limit)
+		} else {
+			c.String(http.StatusRequestEntityTooLarge, "payload must be at most %d bytes", common.MaxUploadSize)
+		}
+		return nil, false
+	} else if err != nil {
+		internalError(c, "reading body", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// storeClip saves an uploaded clip and lets the user's other devices know
+// about it. Clients may pick how long the clip lives, in seconds, through
+// X-Buffer-Lifetime; otherwise the user's default applies. A client that
+// found the payload's hash with HEAD /blob/:hash sends it in X-Buffer-Hash
+// along with an empty body instead of the payload. Only payloads of clips
+// that end up stored count toward the user's upload volume.
+func storeClip(c *gin.Context, uid string, data []byte, hash string, t handlers.BufType, enc string) {
+	var lifetime time.Duration
+	if l := c.GetHeader("X-Buffer-Lifetime"); l != "" {
+		seconds, err := strconv.ParseInt(l, 10, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid lifetime")
+			return
+		}
+
+		lifetime, err = checkLifetime(seconds)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if hash != "" {
+		if !hashRegex.MatchString(hash) {
+			c.String(http.StatusBadRequest, "invalid hash")
+			return
+		}
+
+		if len(data) > 0 && handlers.HashBlob(data) != hash {
+			c.String(http.StatusBadRequest, "hash doesn't match the payload")
+			return
+		}
+	}
+
+	if hash != "" && len(data) == 0 {
+		buf, err := handlers.UpsertBufferByHash(c.Request.Context(), uid, hash, t, enc, lifetime)
+		if err == handlers.ErrNoBlob {
+			c.String(http.StatusConflict, "[error] blob not found")
+			return
+		} else if quotaExceeded(c, err) {
+			return
+		} else if err != nil {
+			internalError(c, "upserting buffer", err)
+			return
+		}
+
+		publishClip(c, uid, buf)
+		return
+	}
+
+	saveClip(c, uid, data, t, enc, lifetime)
+}
+
+// quotaExceeded responds with 507 if err is a *handlers.QuotaError, and
+// reports whether it was.
+func quotaExceeded(c *gin.Context, err error) bool {
+	var qe *handlers.QuotaError
+	if !errors.As(err, &qe) {
+		return false
+	}
+
+	c.String(http.StatusInsufficientStorage, qe.Error())
+	return true
+}
+
+// saveClip stores a clip, tells the user's other devices about it and
+// responds with its expiry. It reports whether the clip was stored.
+func saveClip(c *gin.Context, uid string, data []byte, t handlers.BufType, enc string, lifetime time.Duration) bool {
+	buf, err := handlers.UpsertBuffer(c.Request.Context(), uid, data, t, enc, lifetime)
+	if quotaExceeded(c, err) {
+		return false
+	} else if err != nil {
+		internalError(c, "upserting buffer", err)
+		return false
+	}
+
+	publishClip(c, uid, buf)
+	return true
+}
+
+// currentVersion returns the version of the user's buffer, from the cache
+// unless it has nothing for them, like after a restart.
+func currentVersion(ctx context.Context, uid string) (int64, error) {
+	if v := cache.Get(ctx, uid); v != 0 {
+		return v, nil
+	}
+
+	v, err := handlers.GetVersion(ctx, uid)
+	if err != nil {
+		return 0, err
+	}
+	cache.Set(ctx, uid, v)
+	return v, nil
+}
+
+// publishClip tells the user's other devices about a stored clip and
+// responds with its expiry.
+func publishClip(c *gin.Context, uid string, buf *handlers.Buffer) {
+	metrics.ClipSize.Observe(float64(buf.Size))
+	cache.Set(c.Request.Context(), uid, buf.Version)
+	hub.Publish(uid, hub.Event{
+		Action:     hub.ClipAdded,
+		Id:         buf.Id,
+		Type:       string(buf.Type),
+		Encryption: buf.Encryption,
+		Size:       buf.Size,
+		Time:       buf.Time,
+		Ttl:        buf.Ttl,
+		Version:    buf.Version,
+		Data:       buf.Data,
+	})
+
+	c.Header("X-Buffer-Version", strconv.FormatInt(buf.Version, 10))
+	c.Header("X-Buffer-TTL", strconv.FormatInt(buf.Ttl, 10))
+	c.Data(http.StatusOK, "text/plain", []byte(strconv.FormatInt(buf.Ttl, 10)))
+}
+
+// Setup registers the routes and serves them until ctx is done, then drains
+// the requests in flight.
+func Setup(ctx context.Context, cfg *config.Config) error {
+	setupCookies(cfg)
+
+	// debug mode prints the routes and its warnings as plain text, in the
+	// middle of the JSON logs
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	// client IPs come from X-Forwarded-For only behind the proxies trusted
+	// in the config, so clients can't pick their own to dodge rate limits
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
+	r.Use(logging.Middleware(), logging.Recovery(), metrics.Middleware())
+	setupMetrics(ctx, r, cfg.Metrics)
 
 	r.GET("/", func(c *gin.Context) {
 		c.String(http.StatusOK, "Welcome to Harmony!")
 	})
+	setupHealth(r)
 
+	r.Use(IPRateLimitMiddleware())
+
+	// Signs a device in. The client proves who it is with the OAuth access
+	// token it got from the identity provider, as a bearer token.
 	r.GET("/user", func(c *gin.Context) {
-		e := c.Query("email")
-		uid, err := handlers.CreateOrGetUser(e)
+		oauthToken, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || oauthToken == "" {
+			c.String(http.StatusUnauthorized, "[error] missing access token")
+			return
+		}
+
+		e, err := identity.VerifyToken(c.Request.Context(), oauthToken)
+		if err == identity.ErrInvalidToken {
+			c.String(http.StatusUnauthorized, "[error] invalid access token")
+			return
+		} else if err == identity.ErrNoVerifiedEmail {
+			c.String(http.StatusForbidden, "[error] no verified primary email")
+			return
+		} else if err != nil {
+			slog.ErrorContext(c.Request.Context(), "verifying access token", "error", err)
+			c.String(http.StatusBadGateway, "[error] verifying access token")
+			return
+		}
+
+		uid, err := handlers.CreateOrGetUser(c.Request.Context(), e)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "[error] creating user")
+			internalError(c, "creating user", err)
 			return
 		}
 
-		payload := make(map[string]any)
-		payload["email"] = e
-		payload["user_id"] = uid
+		err = handlers.CheckUser(c.Request.Context(), uid)
+		if err == handlers.ErrUserDisabled {
+			c.String(http.StatusForbidden, "[error] account disabled")
+			return
+		} else if err != nil {
+			internalError(c, "checking user", err)
+			return
+		}
 
-		token, err := utils.GenerateAccessToken(payload, time.Hour*24)
+		name := c.DefaultQuery("device", "unknown")
+		did, err := handlers.RegisterDevice(c.Request.Context(), uid, c.Query("device_id"), name)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "[error] generating token")
+			internalError(c, "registering device", err)
 			return
 		}
 
-		c.SetCookie("access_token", token, 24*int(time.Hour.Seconds()), "/", "", false, true)
-		c.String(http.StatusOK, "")
+		s, refreshToken, err := handlers.CreateSession(c.Request.Context(), uid, did)
+		if err != nil {
+			internalError(c, "creating session", err)
+			return
+		}
+
+		if !issueTokens(c, e, s, refreshToken) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"device_id": did})
 	})
 
+	setupSessions(r)
+
 	r.Use(AuthMiddleware())
+	r.Use(RateLimitMiddleware())
 
 	r.GET("/user/check", func(c *gin.Context) {
 		c.String(http.StatusOK, "")
@@ -79,43 +457,127 @@ func Setup() {
 		}
 		user_id := z.(string)
 
-		t := c.Query("ttl")
-		if t != "" {
-			ts, err := strconv.ParseInt(t, 10, 64)
+		// tells clients that long-polling through `wait` is supported
+		c.Header("X-Buffer-Wait", strconv.Itoa(maxWait))
+
+		// Clients only want the buffer again once there's a newer version
+		// than the one they have.
+		var since int64
+		if v := c.Query("version"); v != "" {
+			vs, err := strconv.ParseInt(v, 10, 64)
 			if err != nil {
-				c.String(http.StatusBadRequest, "invalid timestamp")
+				c.String(http.StatusBadRequest, "invalid version")
 				return
 			}
+			since = vs
+		}
+
+		lts, err := currentVersion(c.Request.Context(), user_id)
+		if err != nil {
+			internalError(c, "getting version", err)
+			return
+		}
+		if since != 0 {
+			if lts <= since && c.Query("wait") != "" {
+				wait, err := strconv.Atoi(c.Query("wait"))
+				if err != nil || wait < 0 {
+					c.String(http.StatusBadRequest, "invalid wait")
+					return
+				}
+				wait = min(wait, maxWait)
+
+				// long-poll: hold the request until a newer buffer shows up
+				ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(wait)*time.Second)
+				stop := context.AfterFunc(stopping, cancel)
+				lts = cache.Wait(ctx, user_id, since)
+				stop()
+				cancel()
+			}
 
-			lts := cache.Get(user_id)
-			if lts <= ts {
+			if lts <= since {
+				metrics.VersionChecks.WithLabelValues("not_modified").Inc()
 				c.String(http.StatusNotModified, "")
 				return
 			}
+			metrics.VersionChecks.WithLabelValues("modified").Inc()
 		}
 
-		buf, bt, ttl, err := handlers.GetBuffer(user_id)
+		buf, err := handlers.GetBuffer(c.Request.Context(), user_id)
 		if err != nil {
 			c.String(http.StatusNoContent, "[error] buffer expired")
 			return
 		}
 
-		ct := "text/plain"
-		if bt == handlers.ImageType {
-			ct = "application/octet-stream"
+		if lts < buf.Version {
+			cache.Set(c.Request.Context(), user_id, buf.Version)
+		}
+		writeBuffer(c, buf)
+	})
+
+	r.GET("/devices", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
 		}
+		user_id := z.(string)
 
-		cache.Set(user_id, ttl)
-		c.Header("X-Buffer-TTL", strconv.FormatInt(ttl, 10))
-		c.Data(http.StatusOK, ct, buf)
+		devices, err := handlers.ListDevices(c.Request.Context(), user_id)
+		if err != nil {
+			internalError(c, "listing devices", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, devices)
 	})
 
-	r.Use(AuthMiddleware()).POST("/clip/text", func(c *gin.Context) {
-		if c.GetHeader("Content-Type") != "text/plain" {
-			c.String(http.StatusBadRequest, "invalid content type")
+	r.DELETE("/devices/:id", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		err := handlers.RevokeDevice(c.Request.Context(), user_id, c.Param("id"))
+		if err == handlers.ErrNoDevice {
+			c.String(http.StatusNotFound, "[error] device not found")
+			return
+		} else if err != nil {
+			internalError(c, "revoking device", err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+
+	setupCertificates(r)
+	setupTokens(r)
+	setupAdmin(r, cfg.AdminEmails)
+
+	r.GET("/ws", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		serveSocket(c, user_id)
+	})
+
+	r.GET("/buffer/events", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
 			return
 		}
+		user_id := z.(string)
 
+		serveEvents(c, user_id)
+	})
+
+	r.GET("/buffer/history", func(c *gin.Context) {
 		z, exists := c.Get("user_id")
 		if !exists {
 			c.String(http.StatusInternalServerError, "[error] getting user_id")
@@ -123,28 +585,162 @@ func Setup() {
 		}
 		user_id := z.(string)
 
-		data, err := io.ReadAll(c.Request.Body)
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.String(http.StatusBadRequest, "invalid offset")
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+		if err != nil || limit < 1 || limit > maxPageSize {
+			c.String(http.StatusBadRequest, "invalid limit")
+			return
+		}
+
+		buffers, total, err := handlers.ListBuffers(c.Request.Context(), user_id, offset, limit)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "[error] reading body")
+			internalError(c, "listing buffers", err)
 			return
 		}
 
-		ttl, err := handlers.UpsertBuffer(user_id, data, handlers.TextType)
+		c.JSON(http.StatusOK, gin.H{
+			"total":  total,
+			"offset": offset,
+			"limit":  limit,
+			"items":  buffers,
+		})
+	})
+
+	r.DELETE("/buffer/history", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		n, version, err := handlers.ClearBuffers(c.Request.Context(), user_id)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "[error] upserting buffer")
+			internalError(c, "clearing buffers", err)
 			return
 		}
 
-		cache.Set(user_id, ttl)
-		c.Data(http.StatusOK, "text/plain", []byte(strconv.FormatInt(ttl, 10)))
+		cache.Set(c.Request.Context(), user_id, version)
+		hub.Publish(user_id, hub.Event{Action: hub.Cleared, Version: version})
+
+		c.JSON(http.StatusOK, gin.H{"deleted": n})
 	})
 
-	r.Use(AuthMiddleware()).POST("/clip/image", func(c *gin.Context) {
-		if c.GetHeader("Content-Type") != "application/octet-stream" {
-			c.String(http.StatusBadRequest, "invalid content type")
+	r.GET("/buffer/:id", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		buf, err := handlers.GetBufferById(c.Request.Context(), user_id, c.Param("id"))
+		if err == handlers.ErrNoBuffer {
+			c.String(http.StatusNotFound, "[error] buffer not found")
+			return
+		} else if err != nil {
+			internalError(c, "getting buffer", err)
+			return
+		}
+
+		writeBuffer(c, buf)
+	})
+
+	r.DELETE("/buffer/:id", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		version, err := handlers.DeleteBuffer(c.Request.Context(), user_id, c.Param("id"))
+		if err == handlers.ErrNoBuffer {
+			c.String(http.StatusNotFound, "[error] buffer not found")
+			return
+		} else if err != nil {
+			internalError(c, "deleting buffer", err)
+			return
+		}
+
+		cache.Set(c.Request.Context(), user_id, version)
+		hub.Publish(user_id, hub.Event{Action: hub.ClipDeleted, Id: c.Param("id"), Version: version})
+
+		c.String(http.StatusOK, "")
+	})
+
+	r.GET("/settings", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		settings, err := handlers.GetSettings(c.Request.Context(), user_id)
+		if err != nil {
+			internalError(c, "getting settings", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, settings)
+	})
+
+	r.PUT("/settings", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		var body struct {
+			HistoryDepth *int   `json:"history_depth"`
+			Lifetime     *int64 `json:"lifetime"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "invalid settings")
+			return
+		}
+
+		settings, err := handlers.GetSettings(c.Request.Context(), user_id)
+		if err != nil {
+			internalError(c, "getting settings", err)
+			return
+		}
+
+		if body.HistoryDepth != nil {
+			if *body.HistoryDepth < 1 || *body.HistoryDepth > common.MaxHistoryDepth {
+				c.String(http.StatusBadRequest, "history_depth must be between 1 and %d", common.MaxHistoryDepth)
+				return
+			}
+			settings.HistoryDepth = *body.HistoryDepth
+		}
+
+		if body.Lifetime != nil {
+			if _, err := checkLifetime(*body.Lifetime); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			settings.Lifetime = *body.Lifetime
+		}
+
+		if err := handlers.SaveSettings(c.Request.Context(), user_id, settings); err != nil {
+			internalError(c, "saving settings", err)
 			return
 		}
 
+		c.JSON(http.StatusOK, settings)
+	})
+
+	// Limits of zero are unlimited. Daily upload volume resets at midnight
+	// UTC.
+	r.GET("/usage", func(c *gin.Context) {
 		z, exists := c.Get("user_id")
 		if !exists {
 			c.String(http.StatusInternalServerError, "[error] getting user_id")
@@ -152,21 +748,149 @@ func Setup() {
 		}
 		user_id := z.(string)
 
-		buf, err := io.ReadAll(c.Request.Body)
+		quota, err := handlers.GetQuota(c.Request.Context(), user_id)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "[error] reading body")
+			internalError(c, "getting quota", err)
 			return
 		}
 
-		ttl, err := handlers.UpsertBuffer(user_id, buf, handlers.ImageType)
+		usage, err := handlers.GetUsage(c.Request.Context(), user_id)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "[error] upserting buffer")
+			internalError(c, "getting usage", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"quota": quota, "usage": usage})
+	})
+
+	// lets clients skip sending payloads the server already has
+	r.HEAD("/blob/:hash", func(c *gin.Context) {
+		hash := c.Param("hash")
+		if !hashRegex.MatchString(hash) {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		user_id := z.(string)
+
+		size, err := handlers.GetBlobSize(c.Request.Context(), user_id, hash)
+		if err == handlers.ErrNoBlob {
+			c.Status(http.StatusNotFound)
+			return
+		} else if err != nil {
+			slog.ErrorContext(c.Request.Context(), "getting blob size", "error", err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("Content-Length", strconv.FormatInt(size, 10))
+		c.Status(http.StatusOK)
+	})
+
+	setupUploads(r)
+
+	r.POST("/clip", func(c *gin.Context) {
+		// Encrypted payloads are opaque bytes, so their type is given in
+		// X-Buffer-Type rather than Content-Type.
+		enc := c.GetHeader("X-Buffer-Encryption")
+		if enc != "" && !encryptionRegex.MatchString(enc) {
+			c.String(http.StatusBadRequest, "invalid encryption")
+			return
+		}
+
+		t := c.GetHeader("X-Buffer-Type")
+		if t == "" {
+			if enc != "" {
+				c.String(http.StatusBadRequest, "missing X-Buffer-Type")
+				return
+			}
+			t = c.GetHeader("Content-Type")
+		}
+
+		bt, err := parseClipType(t)
+		if err != nil {
+			c.String(http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		data, ok := readPayload(c, user_id)
+		if !ok {
+			return
+		}
+
+		storeClip(c, user_id, data, c.GetHeader("X-Buffer-Hash"), bt, enc)
+	})
+
+	r.POST("/clip/text", func(c *gin.Context) {
+		// encrypted payloads are opaque bytes, whatever they decrypt to
+		enc := c.GetHeader("X-Buffer-Encryption")
+		if enc != "" && !encryptionRegex.MatchString(enc) {
+			c.String(http.StatusBadRequest, "invalid encryption")
+			return
+		}
+
+		ct := "text/plain"
+		if enc != "" {
+			ct = "application/octet-stream"
+		}
+		if c.GetHeader("Content-Type") != ct {
+			c.String(http.StatusBadRequest, "invalid content type")
+			return
+		}
+
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		data, ok := readPayload(c, user_id)
+		if !ok {
+			return
+		}
+
+		storeClip(c, user_id, data, "", handlers.TextType, enc)
+	})
+
+	r.POST("/clip/image", func(c *gin.Context) {
+		if c.GetHeader("Content-Type") != "application/octet-stream" {
+			c.String(http.StatusBadRequest, "invalid content type")
+			return
+		}
+
+		enc := c.GetHeader("X-Buffer-Encryption")
+		if enc != "" && !encryptionRegex.MatchString(enc) {
+			c.String(http.StatusBadRequest, "invalid encryption")
+			return
+		}
+
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		buf, ok := readPayload(c, user_id)
+		if !ok {
 			return
 		}
 
-		cache.Set(user_id, ttl)
-		c.Data(http.StatusOK, "text/plain", []byte(strconv.FormatInt(ttl, 10)))
+		storeClip(c, user_id, buf, "", handlers.ImageType, enc)
 	})
 
-	r.Run(":" + os.Getenv("PORT"))
+	return serve(ctx, r, cfg.Port, cfg.TLS)
 }
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"harmony/backend/hub"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const keepAlivePeriod = 30 * time.Second
+
+func writeEvent(c *gin.Context, e hub.Event) {
+	// events without a version, like for a deleted user, leave the last id
+	// as it was
+	var id string
+	if e.Version != 0 {
+		id = hub.EventId(e.Version)
+	}
+
+	c.Render(-1, sse.Event{
+		Id:    id,
+		Event: e.Action,
+		Data:  e,
+	})
+	c.Writer.Flush()
+}
+
+// serveEvents streams the user's buffer changes as Server-Sent Events until
+// the client goes away or its device or session gets revoked. A reconnecting
+// client sends back the last id it saw in Last-Event-ID and first receives
+// whatever it missed in the meantime.
+func serveEvents(c *gin.Context, uid string) {
+	current, err := currentVersion(c.Request.Context(), uid)
+	if err != nil {
+		internalError(c, "getting version", err)
+		return
+	}
+
+	ch, backlog, unsubscribe := hub.SubscribeSince(uid, c.GetHeader("Last-Event-ID"), current)
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	for _, e := range backlog {
+		writeEvent(c, e)
+	}
+
+	ticker := time.NewTicker(keepAlivePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(c, e)
+		case <-ticker.C:
+			if checkSignIn(c) != nil {
+				return
+			}
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		case <-stopping.Done():
+			// clients reconnect to another instance, or this one once
+			// it's back, and resume from Last-Event-ID
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"harmony/backend/common"
+	"harmony/backend/db"
+	"harmony/backend/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthTimeout bounds each of the readiness checks, so a hung dependency
+// fails the probe rather than stalling it.
+const healthTimeout = 2 * time.Second
+
+// started is when the backend came up, which the cleanup check counts from
+// until the job has finished its first run.
+var started = time.Now()
+
+// componentStatus is how one of the things the backend depends on is doing.
+// Degraded components are reported, but don't make the backend unready.
+type componentStatus struct {
+	Status string `json:"status"` // ok, degraded, failing or disabled
+	Error  string `json:"error,omitempty"`
+}
+
+func checkDatabase(ctx context.Context) componentStatus {
+	if err := common.Db.PingContext(ctx); err != nil {
+		return componentStatus{Status: "failing", Error: err.Error()}
+	}
+	return componentStatus{Status: "ok"}
+}
+
+// checkRedis only reports Redis as degraded when it's unreachable, as the
+// cache and the rate limits fall back to local state until it's back.
+func checkRedis(ctx context.Context) componentStatus {
+	if common.Rdb == nil {
+		return componentStatus{Status: "disabled"}
+	}
+	if err := common.Rdb.Ping(ctx).Err(); err != nil {
+		return componentStatus{Status: "degraded", Error: err.Error()}
+	}
+	return componentStatus{Status: "ok"}
+}
+
+func checkCleanup() componentStatus {
+	last := db.LastCleanup()
+	if last.IsZero() {
+		last = started
+	}
+	if since := time.Since(last); since > common.CleanupStaleAfter {
+		return componentStatus{
+			Status: "failing",
+			Error:  fmt.Sprintf("last finished %s ago", since.Truncate(time.Second)),
+		}
+	}
+	return componentStatus{Status: "ok"}
+}
+
+func checkDisk() componentStatus {
+	free, err := utils.FreeSpace(common.DataDir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return componentStatus{Status: "disabled"}
+	} else if err != nil {
+		return componentStatus{Status: "failing", Error: err.Error()}
+	}
+
+	if free < common.MinFreeDisk {
+		return componentStatus{
+			Status: "failing",
+			Error:  fmt.Sprintf("%d bytes free, want at least %d", free, common.MinFreeDisk),
+		}
+	}
+	return componentStatus{Status: "ok"}
+}
+
+// setupHealth registers the probes orchestrators check the backend with.
+// They come before authentication and rate limiting.
+func setupHealth(r *gin.Engine) {
+	// Liveness: the process is up and serving requests.
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// Readiness: the backend can do its job, so traffic may be routed to
+	// it. Responds 503 when any component is failing.
+	r.GET("/readyz", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), healthTimeout)
+		defer cancel()
+
+		components := map[string]componentStatus{
+			"database": checkDatabase(ctx),
+			"redis":    checkRedis(ctx),
+			"cleanup":  checkCleanup(),
+			"disk":     checkDisk(),
+		}
+
+		status, code := "ok", http.StatusOK
+		for _, s := range components {
+			if s.Status == "failing" {
+				status, code = "failing", http.StatusServiceUnavailable
+				break
+			}
+		}
+
+		c.JSON(code, gin.H{"status": status, "components": components})
+	})
+}
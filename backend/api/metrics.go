@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"harmony/backend/config"
+	"harmony/backend/logging"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// setupMetrics exposes the metrics for Prometheus to scrape, either on their
+// own listener at cfg.Addr, which is best kept off the public network, or
+// at /metrics for requests bearing cfg.Token. With neither set they aren't
+// exposed.
+func setupMetrics(ctx context.Context, r *gin.Engine, cfg config.Metrics) {
+	if addr := cfg.Addr; addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		srv := &http.Server{Addr: addr, Handler: mux}
+
+		go func() {
+			slog.Info("serving metrics", "addr", addr)
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logging.Fatal("serving metrics", "error", err)
+			}
+		}()
+
+		// scrapes are quick, there's nothing worth draining
+		context.AfterFunc(ctx, func() { srv.Close() })
+		return
+	}
+
+	token := cfg.Token
+	if token == "" {
+		return
+	}
+
+	h := promhttp.Handler()
+	r.GET("/metrics", func(c *gin.Context) {
+		given := c.GetHeader("Authorization")
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+			return
+		}
+
+		h.ServeHTTP(c.Writer, c.Request)
+	})
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"harmony/backend/common"
+	"harmony/backend/ratelimit"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	readLimit    = ratelimit.Limit{Rate: common.ReadRate, Burst: common.ReadBurst}
+	writeLimit   = ratelimit.Limit{Rate: common.WriteRate, Burst: common.WriteBurst}
+	ipReadLimit  = ratelimit.Limit{Rate: common.ReadRate * common.IPLimitFactor, Burst: common.ReadBurst * common.IPLimitFactor}
+	ipWriteLimit = ratelimit.Limit{Rate: common.WriteRate * common.IPLimitFactor, Burst: common.WriteBurst * common.IPLimitFactor}
+)
+
+// limits returns the kind of request and the limits for the user and for
+// their IP address.
+func limits(c *gin.Context) (string, ratelimit.Limit, ratelimit.Limit) {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return "write", writeLimit, ipWriteLimit
+	}
+	return "read", readLimit, ipReadLimit
+}
+
+// abortLimited turns the request away with a 429, telling the client in
+// Retry-After how many seconds to wait.
+func abortLimited(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests"})
+}
+
+// IPRateLimitMiddleware turns requests away with a 429 once their IP address
+// has used up its reads or writes. It comes before AuthMiddleware, so that
+// signing in and refreshing sessions are limited too. The IP is only taken
+// from X-Forwarded-For when the request comes through a trusted proxy.
+func IPRateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kind, _, ip := limits(c)
+		if ok, wait := ratelimit.Allow(c.Request.Context(), kind+":ip:"+c.ClientIP(), ip); !ok {
+			abortLimited(c, wait)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RateLimitMiddleware turns requests away with a 429 once the user has used
+// up their reads or writes. It has to come after AuthMiddleware.
+func RateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kind, user, _ := limits(c)
+		if ok, wait := ratelimit.Allow(c.Request.Context(), kind+":user:"+c.GetString("user_id"), user); !ok {
+			abortLimited(c, wait)
+			return
+		}
+
+		c.Next()
+	}
+}
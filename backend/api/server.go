@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"harmony/backend/common"
+	"harmony/backend/config"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stopping is done once the server starts shutting down. Requests that
+// would otherwise hold on until the client goes away, like long-polls,
+// event streams and sockets, end early then so draining doesn't wait on
+// them.
+var stopping, stopServing = context.WithCancel(context.Background())
+
+// serve listens on port until ctx is done, over HTTPS when a certificate is
+// configured. It then stops accepting connections, and gives the requests
+// in flight ShutdownTimeout to finish before cutting them off.
+func serve(ctx context.Context, r *gin.Engine, port int, tlsCfg config.TLS) error {
+	srv := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: r}
+	srv.RegisterOnShutdown(stopServing)
+
+	if tlsCfg.Cert != "" {
+		cr, err := newCertReloader(tlsCfg)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{GetConfigForClient: cr.GetConfigForClient}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			slog.Info("listening", "addr", srv.Addr, "tls", true, "client_certs", tlsCfg.ClientCerts)
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+
+		slog.Info("listening", "addr", srv.Addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, draining requests", "timeout", common.ShutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), common.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("requests still in flight after the timeout, closing them", "error", err)
+		return srv.Close()
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"harmony/backend/common"
+	"harmony/backend/config"
+	"harmony/backend/handlers"
+	"harmony/backend/utils"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The refresh token cookie is only sent to the session endpoints, so it
+// doesn't travel with every request like the access token does.
+const sessionPath = "/session"
+
+// Cookies are HttpOnly, and Secure and SameSite as configured.
+var (
+	cookieSecure   bool
+	cookieSameSite = http.SameSiteStrictMode
+)
+
+func setupCookies(cfg *config.Config) {
+	cookieSecure = cfg.SecureCookies()
+	switch cfg.Cookies.SameSite {
+	case "lax":
+		cookieSameSite = http.SameSiteLaxMode
+	case "none":
+		cookieSameSite = http.SameSiteNoneMode
+	default:
+		cookieSameSite = http.SameSiteStrictMode
+	}
+}
+
+func setCookie(c *gin.Context, name, value string, maxAge int, path string) {
+	c.SetSameSite(cookieSameSite)
+	c.SetCookie(name, value, maxAge, path, "", cookieSecure, true)
+}
+
+// issueTokens hands the device a short-lived access token and the session's
+// next refresh token, as cookies.
+func issueTokens(c *gin.Context, email string, s *handlers.Session, refreshToken string) bool {
+	payload := make(map[string]any)
+	payload["email"] = email
+	payload["user_id"] = s.UserId
+	payload["device_id"] = s.DeviceId
+	payload["session_id"] = s.Id
+
+	token, err := utils.GenerateAccessToken(payload, common.AccessTokenLifetime)
+	if err != nil {
+		internalError(c, "generating token", err)
+		return false
+	}
+
+	setCookie(c, "access_token", token, int(common.AccessTokenLifetime.Seconds()), "/")
+	setCookie(c, "refresh_token", refreshToken, int(common.RefreshTokenLifetime.Seconds()), sessionPath)
+	return true
+}
+
+func clearTokens(c *gin.Context) {
+	setCookie(c, "access_token", "", -1, "/")
+	setCookie(c, "refresh_token", "", -1, sessionPath)
+}
+
+// setupSessions registers the endpoints that keep a signed-in device's
+// session going and end it.
+func setupSessions(r *gin.Engine) {
+	r.POST("/session/refresh", func(c *gin.Context) {
+		token, err := c.Cookie("refresh_token")
+		if err != nil || token == "" {
+			c.String(http.StatusUnauthorized, "[error] missing refresh token")
+			return
+		}
+
+		s, next, err := handlers.RefreshSession(c.Request.Context(), token)
+		if err == handlers.ErrTokenReused {
+			slog.WarnContext(c.Request.Context(), "refresh token reused, revoking its session")
+			clearTokens(c)
+			c.String(http.StatusUnauthorized, "[error] refresh token reused")
+			return
+		} else if err == handlers.ErrNoSession || err == handlers.ErrSessionRevoked {
+			clearTokens(c)
+			c.String(http.StatusUnauthorized, "[error] invalid refresh token")
+			return
+		} else if err != nil {
+			internalError(c, "refreshing session", err)
+			return
+		}
+
+		err = handlers.CheckDevice(c.Request.Context(), s.UserId, s.DeviceId)
+		if err == handlers.ErrNoDevice || err == handlers.ErrDeviceRevoked {
+			clearTokens(c)
+			c.String(http.StatusUnauthorized, "[error] device revoked")
+			return
+		} else if err != nil {
+			internalError(c, "checking device", err)
+			return
+		}
+
+		user, err := handlers.GetUser(c.Request.Context(), s.UserId)
+		if err != nil {
+			internalError(c, "getting user", err)
+			return
+		}
+		if user.Disabled {
+			clearTokens(c)
+			c.String(http.StatusUnauthorized, "[error] account disabled")
+			return
+		}
+
+		if !issueTokens(c, user.Email, s, next) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Logging out revokes the session, whichever of its tokens or its pinned
+	// certificate the device still has.
+	r.POST("/session/logout", func(c *gin.Context) {
+		if token, err := c.Cookie("refresh_token"); err == nil && token != "" {
+			if err := handlers.RevokeSessionByToken(c.Request.Context(), token); err != nil {
+				internalError(c, "revoking session", err)
+				return
+			}
+		}
+
+		if token, err := c.Cookie("access_token"); err == nil {
+			if claims, err := utils.VerifyAndDecodeToken(token); err == nil {
+				if sid, _ := claims["session_id"].(string); sid != "" {
+					if err := handlers.RevokeSession(c.Request.Context(), sid); err != nil {
+						internalError(c, "revoking session", err)
+						return
+					}
+				}
+			}
+		}
+
+		// a pinned certificate signs the device in for the session it was
+		// pinned under
+		if fp := clientCertFingerprint(c.Request); fp != "" {
+			d, err := handlers.GetDeviceByCertificate(c.Request.Context(), fp)
+			if err == nil && d.CertSessionId != "" {
+				err = handlers.RevokeSession(c.Request.Context(), d.CertSessionId)
+			}
+			if err != nil && err != handlers.ErrNoDevice {
+				internalError(c, "revoking session", err)
+				return
+			}
+		}
+
+		clearTokens(c)
+		c.Status(http.StatusNoContent)
+	})
+}
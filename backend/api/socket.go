@@ -0,0 +1,125 @@
+package api
+
+import (
+	"harmony/backend/handlers"
+	"harmony/backend/hub"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+)
+
+// socketClip is the message pushed to devices for every new clip.
+type socketClip struct {
+	Id         string `json:"id"`
+	Type       string `json:"type"`
+	Encryption string `json:"encryption,omitempty"`
+	Time       int64  `json:"time"`
+	Ttl        int64  `json:"ttl"`
+	Version    int64  `json:"version"`
+	Data       []byte `json:"data"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// serveSocket upgrades the request and pushes every new clip of the user
+// down the socket until either side goes away or the device or session
+// gets revoked.
+func serveSocket(c *gin.Context, uid string) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		slog.WarnContext(c.Request.Context(), "upgrading websocket", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	ch, unsubscribe := hub.Subscribe(uid)
+	defer unsubscribe()
+
+	// The client never sends anything meaningful; reading is only needed to
+	// process control frames and to notice when the client disconnects.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(pongWait))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-ch:
+			if e.Action != hub.ClipAdded {
+				continue
+			}
+
+			// clips assembled from uploads are published without their
+			// payload, which is too large to hand around
+			if e.Data == nil && e.Size > 0 {
+				buf, err := handlers.GetBufferById(c.Request.Context(), uid, e.Id)
+				if err == handlers.ErrNoBuffer {
+					continue
+				} else if err != nil {
+					slog.ErrorContext(c.Request.Context(), "getting clip for websocket", "error", err)
+					continue
+				}
+				e.Data = buf.Data
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			clip := socketClip{
+				Id:         e.Id,
+				Type:       e.Type,
+				Encryption: e.Encryption,
+				Time:       e.Time,
+				Ttl:        e.Ttl,
+				Version:    e.Version,
+				Data:       e.Data,
+			}
+			if err := conn.WriteJSON(clip); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if checkSignIn(c) != nil {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "signed out"),
+					time.Now().Add(writeWait))
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-done:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(writeWait))
+			return
+		case <-stopping.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(writeWait))
+			return
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"harmony/backend/config"
+	"harmony/backend/handlers"
+	"harmony/backend/logging"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// certCheckInterval bounds how often the certificate files are checked for
+// changes, so handshakes don't each stat them.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the TLS certificate in its files, reloading them when
+// they change. Rotating them takes effect on the next handshake after the
+// check, without a restart.
+type certReloader struct {
+	cfg config.TLS
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	modTimes  [3]time.Time // of the cert, key and client CA files
+	current   *tls.Config
+}
+
+// newCertReloader loads the certificate, failing if it can't be.
+func newCertReloader(cfg config.TLS) (*certReloader, error) {
+	cr := &certReloader{cfg: cfg}
+	modTimes, err := cr.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	cr.current, err = cr.load()
+	if err != nil {
+		return nil, err
+	}
+	cr.modTimes = modTimes
+	cr.lastCheck = time.Now()
+	return cr, nil
+}
+
+// stat returns when the files were last modified.
+func (cr *certReloader) stat() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, path := range []string{cr.cfg.Cert, cr.cfg.Key, cr.cfg.ClientCA} {
+		if path == "" {
+			continue
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load reads the files into the server's TLS settings.
+func (cr *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cr.cfg.Cert, cr.cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+
+	tc := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if !cr.cfg.ClientCerts {
+		return tc, nil
+	}
+
+	// Devices without a certificate still sign in with cookies, so one is
+	// asked for but never required.
+	tc.ClientAuth = tls.RequestClientCert
+	if cr.cfg.ClientCA != "" {
+		pem, err := os.ReadFile(cr.cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in client CA " + cr.cfg.ClientCA)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// GetConfigForClient hands each handshake the current TLS settings, first
+// reloading them if the files changed. A rotation that fails to load keeps
+// the previous certificate in use.
+func (cr *certReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.lastCheck) < certCheckInterval {
+		return cr.current, nil
+	}
+	cr.lastCheck = time.Now()
+
+	modTimes, err := cr.stat()
+	if err != nil {
+		slog.Error("checking certificate files, keeping the current certificate", "error", err)
+		return cr.current, nil
+	}
+	if modTimes == cr.modTimes {
+		return cr.current, nil
+	}
+
+	tc, err := cr.load()
+	if err != nil {
+		slog.Error("reloading certificate, keeping the current one", "error", err)
+		return cr.current, nil
+	}
+
+	cr.current = tc
+	cr.modTimes = modTimes
+	slog.Info("reloaded certificate", "cert", cr.cfg.Cert)
+	return cr.current, nil
+}
+
+// clientCertFingerprint returns the hex encoded SHA-256 of the client
+// certificate the request's connection was made with, or "" without one.
+func clientCertFingerprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certAuth lets through requests from devices presenting the client
+// certificate pinned to them, while the session it was pinned under lasts.
+func certAuth(c *gin.Context, fingerprint string) {
+	d, err := handlers.GetDeviceByCertificate(c.Request.Context(), fingerprint)
+	if err == handlers.ErrNoDevice {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+		return
+	} else if err != nil {
+		abortInternal(c, "getting device", err)
+		return
+	}
+
+	err = handlers.CheckUser(c.Request.Context(), d.UserId)
+	if err == handlers.ErrNoUser || err == handlers.ErrUserDisabled {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+		return
+	} else if err != nil {
+		abortInternal(c, "checking user", err)
+		return
+	}
+
+	err = handlers.CheckDevice(c.Request.Context(), d.UserId, d.Id)
+	if err == handlers.ErrNoDevice || err == handlers.ErrDeviceRevoked {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+		return
+	} else if err != nil {
+		abortInternal(c, "checking device", err)
+		return
+	}
+
+	err = handlers.CheckSession(c.Request.Context(), d.CertSessionId)
+	if err == handlers.ErrNoSession || err == handlers.ErrSessionRevoked {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+		return
+	} else if err != nil {
+		abortInternal(c, "checking session", err)
+		return
+	}
+
+	user, err := handlers.GetUser(c.Request.Context(), d.UserId)
+	if err != nil {
+		abortInternal(c, "getting user", err)
+		return
+	}
+
+	c.Set("user_id", d.UserId)
+	c.Request = c.Request.WithContext(logging.WithUserID(c.Request.Context(), d.UserId))
+	c.Set("email", user.Email)
+	c.Set("device_id", d.Id)
+	c.Set("session_id", d.CertSessionId)
+	c.Next()
+}
+
+// setupCertificates registers the endpoints pinning client certificates to
+// devices. A device pins the certificate it's connected with to itself,
+// after which presenting it signs the device in without cookies until it
+// signs out or its sessions are revoked.
+func setupCertificates(r *gin.Engine) {
+	r.PUT("/devices/:id/certificate", func(c *gin.Context) {
+		user_id := c.GetString("user_id")
+		if c.Param("id") != c.GetString("device_id") {
+			c.String(http.StatusForbidden, "[error] devices can only pin their own certificate")
+			return
+		}
+
+		// the certificate lasts as long as the session it's pinned under,
+		// so one is needed to pin it
+		sid := c.GetString("session_id")
+		if sid == "" {
+			c.String(http.StatusForbidden, "[error] certificates can only be pinned from a signed-in session")
+			return
+		}
+
+		fp := clientCertFingerprint(c.Request)
+		if fp == "" {
+			c.String(http.StatusBadRequest, "[error] no client certificate presented")
+			return
+		}
+
+		err := handlers.SetDeviceCertificate(c.Request.Context(), user_id, c.Param("id"), sid, fp)
+		if err == handlers.ErrNoDevice {
+			c.String(http.StatusNotFound, "[error] device not found")
+			return
+		} else if err == handlers.ErrCertificateInUse {
+			c.String(http.StatusConflict, "[error] certificate pinned to another device")
+			return
+		} else if err != nil {
+			internalError(c, "pinning certificate", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"cert_fingerprint": fp})
+	})
+
+	r.DELETE("/devices/:id/certificate", func(c *gin.Context) {
+		err := handlers.SetDeviceCertificate(c.Request.Context(), c.GetString("user_id"), c.Param("id"), "", "")
+		if err == handlers.ErrNoDevice {
+			c.String(http.StatusNotFound, "[error] device not found")
+			return
+		} else if err != nil {
+			internalError(c, "unpinning certificate", err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+}
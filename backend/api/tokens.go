@@ -0,0 +1,175 @@
+package api
+
+import (
+	"harmony/backend/common"
+	"harmony/backend/handlers"
+	"harmony/backend/logging"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenScopes maps the routes personal access tokens may use to the scope
+// they need. Everything else, like managing devices, settings and the
+// tokens themselves, takes a signed-in session.
+var tokenScopes = map[string]string{
+	"GET /buffer":                    handlers.ScopeRead,
+	"GET /ws":                        handlers.ScopeRead,
+	"GET /buffer/events":             handlers.ScopeRead,
+	"GET /buffer/history":            handlers.ScopeRead,
+	"GET /buffer/:id":                handlers.ScopeRead,
+	"DELETE /buffer/history":         handlers.ScopeDelete,
+	"DELETE /buffer/:id":             handlers.ScopeDelete,
+	"HEAD /blob/:hash":               handlers.ScopePush,
+	"POST /clip":                     handlers.ScopePush,
+	"POST /clip/text":                handlers.ScopePush,
+	"POST /clip/image":               handlers.ScopePush,
+	"POST /uploads":                  handlers.ScopePush,
+	"GET /uploads/:id":               handlers.ScopePush,
+	"PUT /uploads/:id/chunks/:index": handlers.ScopePush,
+	"POST /uploads/:id/finalize":     handlers.ScopePush,
+	"DELETE /uploads/:id":            handlers.ScopePush,
+}
+
+// tokenAuth authenticates a request made with a personal access token.
+func tokenAuth(c *gin.Context, secret string) {
+	t, err := handlers.CheckToken(c.Request.Context(), secret)
+	if err == handlers.ErrNoToken || err == handlers.ErrTokenExpired || err == handlers.ErrTokenRevoked {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+		return
+	} else if err != nil {
+		abortInternal(c, "checking token", err)
+		return
+	}
+
+	err = handlers.CheckUser(c.Request.Context(), t.UserId)
+	if err == handlers.ErrNoUser || err == handlers.ErrUserDisabled {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, nil)
+		return
+	} else if err != nil {
+		abortInternal(c, "checking user", err)
+		return
+	}
+
+	scope, ok := tokenScopes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not available to access tokens"})
+		return
+	}
+	if !slices.Contains(t.Scopes, scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token lacks the " + scope + " scope"})
+		return
+	}
+
+	c.Set("user_id", t.UserId)
+	c.Request = c.Request.WithContext(logging.WithUserID(c.Request.Context(), t.UserId))
+	c.Set("token_id", t.Id)
+	c.Next()
+}
+
+// setupTokens registers the endpoints for managing personal access tokens.
+func setupTokens(r *gin.Engine) {
+	r.GET("/tokens", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		tokens, err := handlers.ListTokens(c.Request.Context(), user_id)
+		if err != nil {
+			internalError(c, "listing tokens", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, tokens)
+	})
+
+	// The token itself is only in this response; the server can't show it
+	// again later.
+	r.POST("/tokens", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		var body struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn int64    `json:"expires_in"` // seconds
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "invalid token")
+			return
+		}
+
+		if body.Name == "" || len(body.Name) > 64 {
+			c.String(http.StatusBadRequest, "name must be between 1 and 64 characters")
+			return
+		}
+
+		if len(body.Scopes) == 0 {
+			c.String(http.StatusBadRequest, "at least one scope is required")
+			return
+		}
+		for _, s := range body.Scopes {
+			if !slices.Contains(handlers.TokenScopes, s) {
+				c.String(http.StatusBadRequest, "unknown scope "+s)
+				return
+			}
+		}
+		slices.Sort(body.Scopes)
+
+		// checked in seconds, before a large value can overflow the
+		// duration
+		maxExpiresIn := int64(common.MaxPersonalTokenLife.Seconds())
+		if body.ExpiresIn < 1 || body.ExpiresIn > maxExpiresIn {
+			c.String(http.StatusBadRequest, "expires_in must be between 1 and %d seconds", maxExpiresIn)
+			return
+		}
+
+		expires := time.Now().Add(time.Duration(body.ExpiresIn) * time.Second).Unix()
+		t := handlers.Token{
+			UserId:  user_id,
+			Name:    body.Name,
+			Scopes:  slices.Compact(body.Scopes),
+			Expires: &expires,
+		}
+
+		secret, err := handlers.CreateToken(c.Request.Context(), &t)
+		if err != nil {
+			internalError(c, "creating token", err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, struct {
+			*handlers.Token
+			Secret string `json:"token"`
+		}{&t, secret})
+	})
+
+	r.DELETE("/tokens/:id", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		err := handlers.RevokeToken(c.Request.Context(), user_id, c.Param("id"))
+		if err == handlers.ErrNoToken {
+			c.String(http.StatusNotFound, "[error] token not found")
+			return
+		} else if err != nil {
+			internalError(c, "revoking token", err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+}
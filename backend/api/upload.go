@@ -0,0 +1,226 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"harmony/backend/common"
+	"harmony/backend/handlers"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultChunkSize = 4 * 1024 * 1024 // bytes
+
+// getUpload loads the upload named in the path, responding with an error when
+// there's none for the user.
+func getUpload(c *gin.Context) (*handlers.Upload, bool) {
+	z, exists := c.Get("user_id")
+	if !exists {
+		c.String(http.StatusInternalServerError, "[error] getting user_id")
+		return nil, false
+	}
+	user_id := z.(string)
+
+	u, err := handlers.GetUpload(c.Request.Context(), user_id, c.Param("id"))
+	if err == handlers.ErrNoUpload {
+		c.String(http.StatusNotFound, "[error] upload not found")
+		return nil, false
+	} else if err != nil {
+		internalError(c, "getting upload", err)
+		return nil, false
+	}
+
+	return u, true
+}
+
+// setupUploads registers the upload-session API, which lets clients send
+// large clips in checksummed chunks and resume after a dropped connection:
+// create an upload, PUT its chunks in any order, GET it to see which chunks
+// arrived, then finalize it into a clip.
+func setupUploads(r *gin.Engine) {
+	r.POST("/uploads", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		var body struct {
+			Type       string `json:"type"`
+			Encryption string `json:"encryption"`
+			Lifetime   int64  `json:"lifetime"`
+			Size       int64  `json:"size"`
+			ChunkSize  int64  `json:"chunk_size"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.String(http.StatusBadRequest, "invalid upload")
+			return
+		}
+
+		bt, err := parseClipType(body.Type)
+		if err != nil {
+			c.String(http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+
+		if body.Encryption != "" && !encryptionRegex.MatchString(body.Encryption) {
+			c.String(http.StatusBadRequest, "invalid encryption")
+			return
+		}
+
+		if body.Lifetime != 0 {
+			if _, err := checkLifetime(body.Lifetime); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		if body.Size < 1 || body.Size > common.MaxUploadSize {
+			c.String(http.StatusRequestEntityTooLarge, "size must be between 1 and %d bytes", common.MaxUploadSize)
+			return
+		}
+
+		err = handlers.CheckUploadQuota(c.Request.Context(), user_id, body.Size)
+		if quotaExceeded(c, err) {
+			return
+		} else if err != nil {
+			internalError(c, "checking quota", err)
+			return
+		}
+
+		if body.ChunkSize == 0 {
+			body.ChunkSize = defaultChunkSize
+		}
+		if body.ChunkSize < 1 || body.ChunkSize > common.MaxChunkSize {
+			c.String(http.StatusBadRequest, "chunk_size must be between 1 and %d bytes", common.MaxChunkSize)
+			return
+		}
+
+		u := handlers.Upload{
+			UserId:     user_id,
+			Type:       bt,
+			Encryption: body.Encryption,
+			Lifetime:   body.Lifetime,
+			Size:       body.Size,
+			ChunkSize:  body.ChunkSize,
+		}
+		if err := handlers.CreateUpload(c.Request.Context(), &u); err != nil {
+			internalError(c, "creating upload", err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, u)
+	})
+
+	r.GET("/uploads/:id", func(c *gin.Context) {
+		u, ok := getUpload(c)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, u)
+	})
+
+	r.PUT("/uploads/:id/chunks/:index", func(c *gin.Context) {
+		u, ok := getUpload(c)
+		if !ok {
+			return
+		}
+
+		i, err := strconv.ParseInt(c.Param("index"), 10, 64)
+		if err != nil || i < 0 || i >= u.ChunkCount() {
+			c.String(http.StatusBadRequest, "invalid chunk index")
+			return
+		}
+
+		checksum := c.GetHeader("X-Chunk-Checksum")
+		if checksum == "" {
+			c.String(http.StatusBadRequest, "missing X-Chunk-Checksum")
+			return
+		}
+
+		length := u.ChunkLength(i)
+		data, err := io.ReadAll(io.LimitReader(c.Request.Body, length+1))
+		if err != nil {
+			internalError(c, "reading body", err)
+			return
+		}
+
+		if int64(len(data)) != length {
+			c.String(http.StatusBadRequest, "chunk %d must be %d bytes", i, length)
+			return
+		}
+
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != checksum {
+			c.String(http.StatusBadRequest, "checksum mismatch")
+			return
+		}
+
+		ch := handlers.Chunk{
+			Index:    i,
+			Offset:   i * u.ChunkSize,
+			Size:     length,
+			Checksum: checksum,
+		}
+		err = handlers.PutChunk(c.Request.Context(), u, ch, data)
+		if err == handlers.ErrUploadFinalizing {
+			c.String(http.StatusConflict, "upload is being finalized")
+			return
+		} else if quotaExceeded(c, err) {
+			return
+		} else if err != nil {
+			internalError(c, "storing chunk", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, ch)
+	})
+
+	r.POST("/uploads/:id/finalize", func(c *gin.Context) {
+		u, ok := getUpload(c)
+		if !ok {
+			return
+		}
+
+		buf, err := handlers.FinalizeUpload(c.Request.Context(), u)
+		if err == handlers.ErrIncompleteUpload {
+			c.String(http.StatusConflict, "upload is missing chunks")
+			return
+		} else if err == handlers.ErrUploadFinalizing {
+			c.String(http.StatusConflict, "upload is being finalized")
+			return
+		} else if quotaExceeded(c, err) {
+			return
+		} else if err != nil {
+			internalError(c, "finalizing upload", err)
+			return
+		}
+
+		publishClip(c, u.UserId, buf)
+	})
+
+	r.DELETE("/uploads/:id", func(c *gin.Context) {
+		z, exists := c.Get("user_id")
+		if !exists {
+			c.String(http.StatusInternalServerError, "[error] getting user_id")
+			return
+		}
+		user_id := z.(string)
+
+		err := handlers.DeleteUpload(c.Request.Context(), user_id, c.Param("id"))
+		if err == handlers.ErrNoUpload {
+			c.String(http.StatusNotFound, "[error] upload not found")
+			return
+		} else if err != nil {
+			internalError(c, "deleting upload", err)
+			return
+		}
+
+		c.String(http.StatusOK, "")
+	})
+}
@@ -1,38 +1,64 @@
+// Package cache tracks the version of each user's buffer, so requests can
+// tell whether there's anything new without going to the database.
+//
+// The implementation is picked with the cache setting: "redis", which
+// shares versions between backend instances through the Redis server at
+// redis.host, or "memory", which keeps them in this process and suits a
+// single instance. It defaults to redis when redis.host is set.
 package cache
 
 import (
+	"context"
 	"harmony/backend/common"
-	"log"
-	"os"
-	"strconv"
-
-	"github.com/redis/go-redis/v9"
+	"harmony/backend/config"
+	"harmony/backend/logging"
 )
 
-func Set(uid string, timestamp int64) {
-	common.Rdb.Set(common.Ctx, uid, timestamp, common.Lifetime)
+type Cache interface {
+	// Set records the version of the user's buffer and wakes up anyone
+	// waiting for it. Versions only go up, so an older one than recorded
+	// is ignored.
+	Set(ctx context.Context, uid string, version int64)
+	// Get returns the version of the user's buffer, or 0 if unknown.
+	Get(ctx context.Context, uid string) int64
+	// Wait blocks until the user's version is newer than since or ctx is
+	// done, and returns the latest version.
+	Wait(ctx context.Context, uid string, since int64) int64
 }
 
-func Get(uid string) int64 {
-	result, err := common.Rdb.Get(common.Ctx, uid).Result()
-	if err != nil {
-		return 0
-	}
+var cache Cache
+
+func Set(ctx context.Context, uid string, version int64) {
+	cache.Set(ctx, uid, version)
+}
+
+func Get(ctx context.Context, uid string) int64 {
+	return cache.Get(ctx, uid)
+}
 
-	t, _ := strconv.ParseInt(result, 10, 64)
-	return t
+func Wait(ctx context.Context, uid string, since int64) int64 {
+	return cache.Wait(ctx, uid, since)
 }
 
-func Setup() {
-	common.Rdb = redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_HOST"),
-		Username: "default",
-		Password: os.Getenv("REDIS_PWD"),
-		DB:       0,
-	})
-
-	_, err := common.Rdb.Ping(common.Ctx).Result()
-	if err != nil {
-		log.Fatal("[error] redis connection failed")
+// Setup picks the implementation named kind, which the config has checked.
+func Setup(kind string, redisCfg config.Redis) {
+	switch kind {
+	case "redis":
+		cache = NewRedisCache(redisCfg)
+	case "memory":
+		cache = NewMemoryCache()
+	default:
+		logging.Fatal("unknown cache", "cache", kind)
+	}
+}
+
+// Close disconnects from Redis, if the cache uses it.
+func Close() error {
+	if common.Rdb == nil {
+		return nil
+	}
+	if c, ok := cache.(*RedisCache); ok {
+		c.sub.Close()
 	}
+	return common.Rdb.Close()
 }
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"harmony/backend/common"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	version int64
+	expires time.Time
+}
+
+// MemoryCache keeps versions in this process. Entries expire like their
+// Redis counterparts and are dropped once read after expiring.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	// closed and replaced on every Set for the user, to wake up waiters
+	notify map[string]chan struct{}
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		entries: make(map[string]memoryEntry),
+		notify:  make(map[string]chan struct{}),
+	}
+}
+
+func (c *MemoryCache) Set(ctx context.Context, uid string, version int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version <= c.get(uid) {
+		return
+	}
+
+	c.entries[uid] = memoryEntry{version: version, expires: time.Now().Add(common.MaxLifetime)}
+	if ch, ok := c.notify[uid]; ok {
+		close(ch)
+		delete(c.notify, uid)
+	}
+}
+
+func (c *MemoryCache) get(uid string) int64 {
+	e, ok := c.entries[uid]
+	if !ok {
+		return 0
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, uid)
+		return 0
+	}
+	return e.version
+}
+
+func (c *MemoryCache) Get(ctx context.Context, uid string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.get(uid)
+}
+
+func (c *MemoryCache) Wait(ctx context.Context, uid string, since int64) int64 {
+	for {
+		c.mu.Lock()
+		t := c.get(uid)
+		if t > since {
+			c.mu.Unlock()
+			return t
+		}
+
+		ch, ok := c.notify[uid]
+		if !ok {
+			ch = make(chan struct{})
+			c.notify[uid] = ch
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return c.Get(ctx, uid)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"context"
+	"harmony/backend/common"
+	"harmony/backend/config"
+	"harmony/backend/metrics"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache shares versions between backend instances through Redis.
+// Everything is also recorded in a local MemoryCache, which takes over
+// while Redis can't be reached; instances then only see their own updates
+// until it's back. Versions other instances announce are recorded in the
+// local cache too, which is what wakes up waiters.
+type RedisCache struct {
+	rdb   *redis.Client
+	local *MemoryCache
+	down  atomic.Bool
+	// the one subscription, to every user's channel
+	sub *redis.PubSub
+}
+
+// NewRedisCache connects to Redis. If it can't be reached, the cache starts
+// out running on the local cache.
+func NewRedisCache(cfg config.Redis) *RedisCache {
+	common.Rdb = redis.NewClient(&redis.Options{
+		Addr:     cfg.Host,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       0,
+	})
+
+	common.Rdb.AddHook(metrics.RedisHook{})
+
+	c := &RedisCache{rdb: common.Rdb, local: NewMemoryCache()}
+	_, err := c.rdb.Ping(common.Ctx).Result()
+	c.check(common.Ctx, err)
+
+	c.sub = c.rdb.PSubscribe(common.Ctx, channel("*"))
+	go c.listen()
+	return c
+}
+
+// listen records the versions announced on the user channels until the
+// subscription is closed. The subscription reconnects by itself after
+// Redis goes away; what's announced in the meantime is missed, but waiters
+// still see it through Get once they're woken up or time out.
+func (c *RedisCache) listen() {
+	for msg := range c.sub.Channel() {
+		uid, ok := strings.CutPrefix(msg.Channel, channel(""))
+		if !ok {
+			continue
+		}
+		version, err := strconv.ParseInt(msg.Payload, 10, 64)
+		if err != nil {
+			continue
+		}
+		c.local.Set(common.Ctx, uid, version)
+	}
+}
+
+// check notes whether Redis is reachable, judging by the error of the last
+// command, and reports whether it is.
+func (c *RedisCache) check(ctx context.Context, err error) bool {
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up, which says nothing about Redis
+		return false
+	}
+	if err != nil && err != redis.Nil {
+		if !c.down.Swap(true) {
+			metrics.CacheDegraded.Set(1)
+			slog.WarnContext(ctx, "redis unavailable, falling back to the local cache", "error", err)
+		}
+		return false
+	}
+
+	if c.down.Swap(false) {
+		metrics.CacheDegraded.Set(0)
+		slog.InfoContext(ctx, "redis is back, leaving the local cache")
+	}
+	return true
+}
+
+// channel is where Set announces a new version for the user, so waiters on
+// every backend instance get woken up.
+func channel(uid string) string {
+	return "buffer:" + uid
+}
+
+// setScript records a version unless a newer one is, so instances racing
+// to record theirs can't move it back. It returns 1 if it recorded it.
+var setScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1])) or 0
+if tonumber(ARGV[1]) <= current then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// Set records the version of the user's buffer. It's kept for as long as
+// any clip may live.
+func (c *RedisCache) Set(ctx context.Context, uid string, version int64) {
+	c.local.Set(ctx, uid, version)
+
+	// other instances have to hear about it even if the request that made
+	// the update is gone
+	ctx = context.WithoutCancel(ctx)
+	set, err := setScript.Run(ctx, c.rdb, []string{uid}, version, common.MaxLifetime.Milliseconds()).Int()
+	if c.check(ctx, err) && set == 1 {
+		c.rdb.Publish(ctx, channel(uid), version)
+	}
+}
+
+// Get returns the newer of the shared version and the local one, which is
+// ahead when Redis missed updates while it was away.
+func (c *RedisCache) Get(ctx context.Context, uid string) int64 {
+	local := c.local.Get(ctx, uid)
+
+	result, err := c.rdb.Get(ctx, uid).Result()
+	if !c.check(ctx, err) || err == redis.Nil {
+		return local
+	}
+
+	t, _ := strconv.ParseInt(result, 10, 64)
+	return max(t, local)
+}
+
+// Wait blocks until the user's version is newer than since or ctx is done,
+// and returns the latest version. It waits on the local cache, which hears
+// about updates from every instance while Redis is up and from this one
+// while it's away.
+func (c *RedisCache) Wait(ctx context.Context, uid string, since int64) int64 {
+	if t := c.Get(ctx, uid); t > since {
+		// catch the local cache up, in case the announcement was missed
+		c.local.Set(ctx, uid, t)
+		return t
+	}
+
+	c.local.Wait(ctx, uid, since)
+
+	// the latest version is still looked up once ctx is done
+	return c.Get(context.WithoutCancel(ctx), uid)
+}
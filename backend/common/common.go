@@ -9,7 +9,69 @@ import (
 )
 
 const (
-	Lifetime = 5 * time.Minute
+	MinLifetime     = 30 * time.Second
+	MaxLifetime     = 7 * 24 * time.Hour
+	HistoryDepth    = 20
+	MaxHistoryDepth = 100
+
+	MaxUploadSize  = 128 * 1024 * 1024 // bytes
+	MaxChunkSize   = 8 * 1024 * 1024   // bytes
+	UploadLifetime = time.Hour         // since the last chunk arrived
+
+	BlobGracePeriod = 10 * time.Minute // after a blob's last clip is gone
+
+	CleanupInterval = 1 * time.Minute // between runs of the cleanup job
+
+	// Readiness fails when the cleanup job hasn't finished a run in
+	// CleanupStaleAfter, or the data directory has less than MinFreeDisk
+	// left.
+	CleanupStaleAfter = 5 * CleanupInterval
+	MinFreeDisk       = 256 * 1024 * 1024 // bytes
+
+	// How long requests in flight get to finish when the backend is told
+	// to stop.
+	ShutdownTimeout = 30 * time.Second
+
+	AccessTokenLifetime  = 15 * time.Minute
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+	MaxPersonalTokenLife = 365 * 24 * time.Hour
+
+	// Requests per second each user may make once through their burst.
+	// Writes are anything but GET and HEAD. Each IP address gets
+	// IPLimitFactor times as much, as several users may share one.
+	ReadRate      = 5
+	ReadBurst     = 60
+	WriteRate     = 1
+	WriteBurst    = 30
+	IPLimitFactor = 4
+
+	// Defaults of the quota.storage, quota.clips and quota.daily_upload
+	// settings, which per-user overrides take precedence over. Zero means
+	// unlimited.
+	StorageQuota     = 1024 * 1024 * 1024     // bytes
+	ClipQuota        = 0                      // clips
+	DailyUploadQuota = 2 * 1024 * 1024 * 1024 // bytes per UTC day
+)
+
+// ClipTypes lists the MIME types clips may have.
+var ClipTypes = []string{
+	"text/plain",
+	"text/html",
+	"text/rtf",
+	"application/rtf",
+	"text/uri-list",
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/bmp",
+	"image/svg+xml",
+}
+
+// Set from the config at startup, these are their defaults.
+var (
+	Lifetime = 5 * time.Minute // of clips, for users who haven't picked one
+	DataDir  = "./data"        // where the database lives
 )
 
 var (
@@ -0,0 +1,293 @@
+// Package config holds the backend's settings. They're loaded from, in
+// increasing order of precedence, a YAML config file, env vars and command
+// line flags, and checked before anything starts.
+//
+// Every setting has a key in the config file, an env var and a flag: the
+// config file's redis.host is the REDIS_HOST env var and the -redis-host
+// flag. The env vars are the ones the backend has always read.
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"harmony/backend/common"
+	"harmony/backend/identity"
+	"log/slog"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Port                 int           `yaml:"port" env:"PORT" help:"port the API is served on"`
+	JWTSecret            string        `yaml:"jwt_secret" env:"JWT_SK" secret:"true" help:"base64 encoded key access tokens are signed with"`
+	DataDir              string        `yaml:"data_dir" env:"DATA_DIR" help:"directory the database is kept in"`
+	LogLevel             string        `yaml:"log_level" env:"LOG_LEVEL" help:"least severe level logged: debug, info, warn or error"`
+	Lifetime             time.Duration `yaml:"lifetime" env:"CLIP_LIFETIME" help:"how long clips live, for users who haven't picked a lifetime"`
+	IdentityEmailsURL    string        `yaml:"identity_emails_url" env:"IDENTITY_EMAILS_URL" help:"identity provider endpoint listing the emails of an access token's account"`
+	IdentityClientID     string        `yaml:"identity_client_id" env:"IDENTITY_CLIENT_ID" help:"OAuth app of the identity provider that access tokens must be issued to"`
+	IdentityClientSecret string        `yaml:"identity_client_secret" env:"IDENTITY_CLIENT_SECRET" secret:"true" help:"client secret of identity_client_id, to check access tokens with"`
+	IdentityTokenURL     string        `yaml:"identity_token_url" env:"IDENTITY_TOKEN_URL" help:"identity provider endpoint telling which app an access token was issued to; GitHub's for identity_client_id by default"`
+	AdminEmails          []string      `yaml:"admin_emails" env:"ADMIN_EMAILS" help:"comma separated accounts allowed to use the admin API"`
+	Cache                string        `yaml:"cache" env:"CACHE" help:"version cache, redis or memory; redis by default when redis.host is set"`
+	TrustedProxies       []string      `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" help:"comma separated IPs or CIDRs of proxies whose X-Forwarded-For gives the client's IP; none by default"`
+
+	Redis   Redis   `yaml:"redis"`
+	Storage Storage `yaml:"storage"`
+	Quota   Quota   `yaml:"quota"`
+	Metrics Metrics `yaml:"metrics"`
+	TLS     TLS     `yaml:"tls"`
+	Cookies Cookies `yaml:"cookies"`
+}
+
+type Redis struct {
+	Host     string `yaml:"host" env:"REDIS_HOST" help:"Redis server, as host:port"`
+	Username string `yaml:"username" env:"REDIS_USERNAME" help:"user to authenticate to Redis as"`
+	Password string `yaml:"password" env:"REDIS_PWD" secret:"true" help:"password to authenticate to Redis with"`
+}
+
+type Storage struct {
+	Backend string `yaml:"backend" env:"STORAGE" help:"where payloads are kept: sqlite, fs or s3"`
+	Dir     string `yaml:"dir" env:"STORAGE_DIR" help:"directory the fs backend keeps payloads in; blobs in the data directory by default"`
+	S3      S3     `yaml:"s3"`
+}
+
+type S3 struct {
+	Endpoint  string `yaml:"endpoint" env:"S3_ENDPOINT" help:"S3 service, as host[:port] without a scheme"`
+	Bucket    string `yaml:"bucket" env:"S3_BUCKET" help:"bucket payloads are kept in"`
+	AccessKey string `yaml:"access_key" env:"S3_ACCESS_KEY" help:"S3 access key"`
+	SecretKey string `yaml:"secret_key" env:"S3_SECRET_KEY" secret:"true" help:"S3 secret key"`
+	Region    string `yaml:"region" env:"S3_REGION" help:"S3 region"`
+	UseSSL    bool   `yaml:"use_ssl" env:"S3_USE_SSL" help:"talk to S3 over TLS"`
+}
+
+// Quota is the default quota of every user. Zero means unlimited.
+type Quota struct {
+	Storage     int64 `yaml:"storage" env:"QUOTA_STORAGE" help:"bytes of payloads each user may store"`
+	Clips       int64 `yaml:"clips" env:"QUOTA_CLIPS" help:"clips each user may keep"`
+	DailyUpload int64 `yaml:"daily_upload" env:"QUOTA_DAILY_UPLOAD" help:"bytes each user may upload per UTC day"`
+}
+
+type Metrics struct {
+	Addr  string `yaml:"addr" env:"METRICS_ADDR" help:"address to serve metrics on, apart from the API"`
+	Token string `yaml:"token" env:"METRICS_TOKEN" secret:"true" help:"bearer token to serve metrics at /metrics of the API with"`
+}
+
+// TLS has the API served over HTTPS. The certificate and key files are
+// reloaded when they change, so they can be rotated without a restart.
+type TLS struct {
+	Cert        string `yaml:"cert" env:"TLS_CERT" help:"PEM certificate chain to serve HTTPS with; plain HTTP without one"`
+	Key         string `yaml:"key" env:"TLS_KEY" help:"PEM private key of tls.cert"`
+	ClientCerts bool   `yaml:"client_certs" env:"TLS_CLIENT_CERTS" help:"ask devices for client certificates, which sign in the devices they're pinned to"`
+	ClientCA    string `yaml:"client_ca" env:"TLS_CLIENT_CA" help:"PEM certificates client certificates must be issued by; any are accepted without it"`
+}
+
+type Cookies struct {
+	Secure   string `yaml:"secure" env:"COOKIE_SECURE" help:"only send cookies over HTTPS: true, false, or auto for when tls.cert is set"`
+	SameSite string `yaml:"same_site" env:"COOKIE_SAME_SITE" help:"SameSite attribute of cookies: strict, lax or none"`
+}
+
+// SecureCookies reports whether cookies are marked Secure.
+func (c *Config) SecureCookies() bool {
+	if c.Cookies.Secure == "auto" {
+		return c.TLS.Cert != ""
+	}
+	return c.Cookies.Secure == "true"
+}
+
+// Default returns the settings used where nothing else is given.
+func Default() *Config {
+	return &Config{
+		DataDir:           common.DataDir,
+		LogLevel:          "info",
+		Lifetime:          common.Lifetime,
+		IdentityEmailsURL: identity.DefaultEmailsURL,
+		IdentityClientID:  identity.DefaultClientID,
+		Redis:             Redis{Username: "default"},
+		Storage: Storage{
+			Backend: "sqlite",
+			S3:      S3{UseSSL: true},
+		},
+		Quota: Quota{
+			Storage:     common.StorageQuota,
+			Clips:       common.ClipQuota,
+			DailyUpload: common.DailyUploadQuota,
+		},
+		Cookies: Cookies{Secure: "auto", SameSite: "strict"},
+	}
+}
+
+// JWTKey returns the decoded signing key.
+func (c *Config) JWTKey() []byte {
+	key, _ := base64.StdEncoding.DecodeString(c.JWTSecret)
+	return key
+}
+
+// SlogLevel returns the log level as slog has it.
+func (c *Config) SlogLevel() slog.Level {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.LogLevel))
+	return level
+}
+
+// resolve fills in the settings whose defaults depend on others.
+func (c *Config) resolve() {
+	if c.Cache == "" {
+		c.Cache = "memory"
+		if c.Redis.Host != "" {
+			c.Cache = "redis"
+		}
+	}
+
+	if c.IdentityTokenURL == "" {
+		c.IdentityTokenURL = identity.DefaultTokenURL(c.IdentityClientID)
+	}
+
+	if c.Storage.Dir == "" {
+		c.Storage.Dir = filepath.Join(c.DataDir, "blobs")
+	}
+
+	for i, e := range c.AdminEmails {
+		c.AdminEmails[i] = strings.ToLower(e)
+	}
+}
+
+// validate returns everything wrong with the settings at once.
+func (c *Config) validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		fail("port must be between 1 and 65535, got %d", c.Port)
+	}
+
+	if c.JWTSecret == "" {
+		fail("jwt_secret must be set")
+	} else if _, err := base64.StdEncoding.DecodeString(c.JWTSecret); err != nil {
+		fail("jwt_secret must be base64 encoded: %v", err)
+	}
+
+	if c.DataDir == "" {
+		fail("data_dir must be set")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		fail("log_level must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+
+	if c.Lifetime < common.MinLifetime || c.Lifetime > common.MaxLifetime {
+		fail("lifetime must be between %s and %s, got %s", common.MinLifetime, common.MaxLifetime, c.Lifetime)
+	}
+
+	for _, u := range []struct {
+		key   string
+		value string
+	}{
+		{"identity_emails_url", c.IdentityEmailsURL},
+		{"identity_token_url", c.IdentityTokenURL},
+	} {
+		if p, err := url.Parse(u.value); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			fail("%s must be an http or https URL, got %q", u.key, u.value)
+		}
+	}
+
+	// without the secret, there's no telling whether access tokens were
+	// issued to harmony or to any other app
+	if c.IdentityClientID == "" || c.IdentityClientSecret == "" {
+		fail("identity_client_id and identity_client_secret must be set")
+	}
+
+	for _, e := range c.AdminEmails {
+		if !strings.Contains(e, "@") {
+			fail("admin_emails must be emails, got %q", e)
+		}
+	}
+
+	for _, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			fail("trusted_proxies must be IPs or CIDRs, got %q", p)
+		}
+	}
+
+	switch c.Cache {
+	case "memory":
+	case "redis":
+		if c.Redis.Host == "" {
+			fail("redis.host must be set for the redis cache")
+		}
+	default:
+		fail("cache must be redis or memory, got %q", c.Cache)
+	}
+
+	if c.Redis.Host != "" {
+		if _, _, err := net.SplitHostPort(c.Redis.Host); err != nil {
+			fail("redis.host must be host:port, got %q", c.Redis.Host)
+		}
+	}
+
+	switch c.Storage.Backend {
+	case "sqlite", "fs":
+	case "s3":
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			fail("storage.s3.endpoint and storage.s3.bucket must be set for the s3 storage")
+		}
+		if strings.Contains(c.Storage.S3.Endpoint, "://") {
+			fail("storage.s3.endpoint must not have a scheme, got %q", c.Storage.S3.Endpoint)
+		}
+	default:
+		fail("storage.backend must be sqlite, fs or s3, got %q", c.Storage.Backend)
+	}
+
+	for _, q := range []struct {
+		key   string
+		value int64
+	}{
+		{"quota.storage", c.Quota.Storage},
+		{"quota.clips", c.Quota.Clips},
+		{"quota.daily_upload", c.Quota.DailyUpload},
+	} {
+		if q.value < 0 {
+			fail("%s must be at least 0, got %d", q.key, q.value)
+		}
+	}
+
+	if c.Metrics.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Addr); err != nil {
+			fail("metrics.addr must be host:port, got %q", c.Metrics.Addr)
+		}
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		fail("tls.cert and tls.key must be set together")
+	}
+	if c.TLS.ClientCerts && c.TLS.Cert == "" {
+		fail("tls.cert must be set for tls.client_certs")
+	}
+	if c.TLS.ClientCA != "" && !c.TLS.ClientCerts {
+		fail("tls.client_certs must be set for tls.client_ca")
+	}
+
+	switch c.Cookies.Secure {
+	case "auto", "true", "false":
+	default:
+		fail("cookies.secure must be auto, true or false, got %q", c.Cookies.Secure)
+	}
+
+	switch c.Cookies.SameSite {
+	case "strict", "lax":
+	case "none":
+		if !c.SecureCookies() {
+			fail("cookies.same_site none needs secure cookies")
+		}
+	default:
+		fail("cookies.same_site must be strict, lax or none, got %q", c.Cookies.SameSite)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,295 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// field is one setting of a Config.
+type field struct {
+	key    string // in the config file, like redis.host
+	env    string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+// fields lists the settings of c, in the order Config declares them.
+func fields(c *Config) []field {
+	return walk(reflect.ValueOf(c).Elem(), "")
+}
+
+func walk(v reflect.Value, prefix string) []field {
+	var fs []field
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		key := prefix + sf.Tag.Get("yaml")
+		if sf.Type.Kind() == reflect.Struct {
+			fs = append(fs, walk(v.Field(i), key+".")...)
+			continue
+		}
+
+		fs = append(fs, field{
+			key:    key,
+			env:    sf.Tag.Get("env"),
+			help:   sf.Tag.Get("help"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fs
+}
+
+// flag is the name of the setting's flag, like redis-host.
+func (f field) flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.key)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses s into the setting. Lists are comma separated.
+func (f field) set(s string) error {
+	switch {
+	case f.value.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		f.value.SetInt(int64(d))
+	case f.value.Kind() == reflect.String:
+		f.value.SetString(s)
+	case f.value.Kind() == reflect.Int || f.value.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		f.value.SetInt(n)
+	case f.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		f.value.SetBool(b)
+	case f.value.Kind() == reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+	default:
+		panic("config: unsupported setting type " + f.value.Type().String())
+	}
+	return nil
+}
+
+// String formats the setting the way set parses it.
+func (f field) String() string {
+	switch v := f.value.Interface().(type) {
+	case time.Duration:
+		return v.String()
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// flagValue holds a flag until the settings from the config file and the env
+// have been applied, which it then overrides.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string     { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool   { return v.isBool }
+
+// Load reads the settings, and fails if any of them is invalid. It adds a
+// flag for each setting to fs and parses args with it. The config file is
+// named with the -config flag or the CONFIG_FILE env var; without either
+// there's none. Empty env vars count as unset.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := Default()
+	all := fields(c)
+
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file to read settings from (env CONFIG_FILE)")
+	flags := make(map[string]*flagValue, len(all))
+	for _, f := range all {
+		v := &flagValue{isBool: f.value.Kind() == reflect.Bool}
+		if !f.secret {
+			v.value = f.String()
+		}
+		flags[f.flag()] = v
+		fs.Var(v, f.flag(), fmt.Sprintf("%s (env %s)", f.help, f.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	if *path != "" {
+		if err := loadFile(*path, all); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, f := range all {
+		if v := os.Getenv(f.env); v != "" {
+			if err := f.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("env var %s: %w", f.env, err))
+			}
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+	for _, f := range all {
+		if set[f.flag()] {
+			if err := f.set(flags[f.flag()].value); err != nil {
+				errs = append(errs, fmt.Errorf("flag -%s: %w", f.flag(), err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	c.resolve()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile applies the settings in the YAML file at path.
+func loadFile(path string, all []field) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	byKey := make(map[string]field, len(all))
+	for _, f := range all {
+		byKey[f.key] = f
+	}
+
+	values := make(map[string]string)
+	flatten(doc, "", values)
+
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		v := values[key]
+		f, ok := byKey[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("config file %s: unknown setting %s", path, key))
+			continue
+		}
+		if err := f.set(v); err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flatten collects the values in the YAML mapping m by their dotted keys,
+// formatted the way field.set parses them.
+func flatten(m map[string]any, prefix string, out map[string]string) {
+	for k, v := range m {
+		switch v := v.(type) {
+		case nil:
+		case map[string]any:
+			flatten(v, prefix+k+".", out)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			out[prefix+k] = strings.Join(items, ",")
+		default:
+			out[prefix+k] = fmt.Sprint(v)
+		}
+	}
+}
+
+// Print writes the settings to w in the config file's format, with secrets
+// redacted.
+func (c *Config) Print(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, f := range fields(c) {
+		parts := strings.Split(f.key, ".")
+		m := root
+		for _, p := range parts[:len(parts)-1] {
+			m = child(m, p)
+		}
+
+		key := &yaml.Node{
+			Kind:        yaml.ScalarNode,
+			Value:       parts[len(parts)-1],
+			HeadComment: fmt.Sprintf("%s (%s)", f.help, f.env),
+		}
+		m.Content = append(m.Content, key, valueNode(f))
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// child returns the mapping under key in the mapping m, adding it if need be.
+func child(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+
+	c := &yaml.Node{Kind: yaml.MappingNode}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, c)
+	return c
+}
+
+func valueNode(f field) *yaml.Node {
+	if f.secret && f.String() != "" {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "REDACTED"}
+	}
+
+	switch v := f.value.Interface().(type) {
+	case []string:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range v {
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+		}
+		return n
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: f.String()}
+	case int, int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: f.String()}
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: f.String()}
+	}
+}
@@ -1,88 +1,118 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"harmony/backend/common"
-	"log"
+	"harmony/backend/config"
+	"harmony/backend/handlers"
+	"harmony/backend/metrics"
+	"harmony/backend/storage"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
 )
 
-func createTableIfNotExists(tableName string, schema string) error {
-	// Check if table exists
-	var count int
-	err := common.Db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", tableName).Scan(&count)
-	if err != nil {
-		return fmt.Errorf("[error] checking for table %s: %w", tableName, err)
-	}
+// driverName is SQLite with its statements timed for the metrics.
+const driverName = "sqlite+metrics"
 
-	if count > 0 {
-		log.Printf("Table %s already exists, skipping creation.\n", tableName)
-		return nil
-	}
+func init() {
+	sql.Register(driverName, metrics.WrapDriver(&sqlite.Driver{}))
+}
 
-	// Create the table if it doesn't exist
-	_, err = common.Db.Exec(schema)
-	if err != nil {
-		return fmt.Errorf("[error] failed to create table %s: %w", tableName, err)
-	}
+// busyTimeout is how long a connection waits for the database to be
+// unlocked by another.
+const busyTimeout = 5 * time.Second
 
-	log.Printf("Table %s created successfully.\n", tableName)
-	return nil
+// lastCleanup is when the cleanup job last finished a run, in Unix seconds.
+var lastCleanup atomic.Int64
+
+// LastCleanup returns when the cleanup job last finished a run, or the zero
+// time if it hasn't yet.
+func LastCleanup() time.Time {
+	if t := lastCleanup.Load(); t != 0 {
+		return time.Unix(t, 0)
+	}
+	return time.Time{}
 }
 
-func StartLightweightCleanupJob() {
+// cleanupDone is closed once the cleanup job has stopped.
+var cleanupDone chan struct{}
+
+// StartLightweightCleanupJob runs the cleanup every CleanupInterval until ctx
+// is done, which also cuts short a run in progress.
+func StartLightweightCleanupJob(ctx context.Context) {
+	cleanupDone = make(chan struct{})
 	go func() {
+		defer close(cleanupDone)
 		for {
-			_, err := common.Db.Exec("DELETE FROM buffer WHERE ttl < unixepoch()")
-			if err != nil {
-				log.Printf("Error cleaning up expired buffers: %v", err)
+			start := time.Now()
+
+			for _, job := range []struct {
+				kind  string
+				query string
+				args  []any
+			}{
+				{"buffer", "DELETE FROM buffer WHERE ttl < unixepoch()", nil},
+				{"upload_volume", "DELETE FROM upload_volume WHERE day < unixepoch() / 86400 - 1", nil},
+				{"refresh_token", "DELETE FROM refresh_token WHERE expires < unixepoch()", nil},
+				{"session", `
+					DELETE FROM session
+					WHERE _id NOT IN (SELECT session_id FROM refresh_token)
+						AND _id NOT IN (SELECT cert_session_id FROM device WHERE cert_session_id IS NOT NULL)`, nil},
+			} {
+				res, err := common.Db.ExecContext(ctx, job.query, job.args...)
+				if ctx.Err() != nil {
+					return
+				} else if err != nil {
+					slog.Error("cleaning up", "kind", job.kind, "error", err)
+					continue
+				}
+				if n, err := res.RowsAffected(); err == nil {
+					metrics.CleanupDeleted.WithLabelValues(job.kind).Add(float64(n))
+				}
 			}
-			time.Sleep(1 * time.Minute)
-		}
-	}()
-}
 
-func setupTables() error {
-	userSchema := `
-	CREATE TABLE user (
-		_id TEXT PRIMARY KEY,
-		email TEXT UNIQUE
-	);
-	CREATE INDEX IF NOT EXISTS email_index ON user(email);
-	`
-
-	bufferSchema := `
-	CREATE TABLE buffer (
-		_id TEXT PRIMARY KEY,
-		user_id TEXT NOT NULL,
-		time INTEGER NOT NULL,
-		ttl INTEGER NOT NULL,
-		type TEXT NOT NULL,
-		data BLOB,
-		FOREIGN KEY (user_id) REFERENCES user(_id)
-	);
-	CREATE INDEX IF NOT EXISTS userid_index ON buffer(user_id);
-	`
-
-	if err := createTableIfNotExists("user", userSchema); err != nil {
-		return fmt.Errorf("[error] creating user table: %v", err)
-	}
+			// uploads nobody has touched in a while are abandoned
+			n, err := handlers.CollectUploads(ctx, start.Add(-common.UploadLifetime))
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				slog.Error("cleaning up abandoned uploads", "error", err)
+			}
+			metrics.CleanupDeleted.WithLabelValues("upload").Add(float64(n))
+
+			// blobs stay around for a grace period after their last clip is
+			// gone, so clients that just saw them can still refer to them
+			n, err = handlers.CollectBlobs(ctx, time.Now().Add(-common.BlobGracePeriod))
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				slog.Error("cleaning up unreferenced blobs", "error", err)
+			}
+			metrics.CleanupDeleted.WithLabelValues("blob").Add(float64(n))
 
-	if err := createTableIfNotExists("buffer", bufferSchema); err != nil {
-		return fmt.Errorf("[error] creating buffer table: %v", err)
-	}
+			metrics.CleanupDuration.Observe(time.Since(start).Seconds())
+			metrics.CleanupLastRun.SetToCurrentTime()
+			lastCleanup.Store(time.Now().Unix())
 
-	StartLightweightCleanupJob()
-	return nil
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(common.CleanupInterval):
+			}
+		}
+	}()
 }
 
-func Setup() error {
-	dbDir := "./data"
+// Open opens the database in the data directory, creating it if need be.
+func Open() error {
+	dbDir := common.DataDir
 	if err := os.MkdirAll(dbDir, 0755); err != nil {
 		return fmt.Errorf("failed to create database directory: %w", err)
 	}
@@ -97,7 +127,13 @@ func Setup() error {
 		file.Close()
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
+	// Pragmas other than journal_mode only hold for the connection they
+	// run on, so they're set in the DSN, which the driver applies to each
+	// connection the pool opens. Writers wait for each other for up to
+	// busyTimeout instead of failing with SQLITE_BUSY.
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)",
+		dbPath, busyTimeout.Milliseconds())
+	db, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return fmt.Errorf("unable to open SQLite database: %w", err)
 	}
@@ -107,20 +143,36 @@ func Setup() error {
 	}
 	common.Db = db
 
-	_, err = db.Exec("PRAGMA foreign_keys = ON")
-	if err != nil {
-		return fmt.Errorf("failed to enable foreign key constraints: %w", err)
+	return nil
+}
+
+// Setup opens the database and sets up storage for payloads as cfg says,
+// and then brings the schema up to date, which may move payloads to
+// storage. Background jobs run until ctx is done.
+func Setup(ctx context.Context, cfg config.Storage) error {
+	if err := Open(); err != nil {
+		return err
 	}
 
-	_, err = db.Exec("PRAGMA journal_mode = WAL")
-	if err != nil {
-		return fmt.Errorf("failed to enable WAL mode: %w", err)
+	if err := storage.Setup(cfg); err != nil {
+		return fmt.Errorf("failed to set up storage: %w", err)
 	}
 
-	if err := setupTables(); err != nil {
+	if err := Migrate(ctx, false); err != nil {
 		return err
 	}
 
-	log.Println("SQLite database setup completed successfully")
+	StartLightweightCleanupJob(ctx)
+
+	slog.Info("database setup completed")
 	return nil
 }
+
+// Close waits for the background jobs to stop, and then closes the
+// database once the queries running on it are done.
+func Close() error {
+	if cleanupDone != nil {
+		<-cleanupDone
+	}
+	return common.Db.Close()
+}
@@ -0,0 +1,423 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"harmony/backend/common"
+	"harmony/backend/handlers"
+	"harmony/backend/storage"
+	"log/slog"
+)
+
+// A migration brings the schema from the version before it to its own. Once
+// released, a migration must never change: changes to the schema go into a
+// new one at the end of migrations.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// sqlMigration is a migration that runs the statements in stmts.
+func sqlMigration(stmts string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, stmts)
+		return err
+	}
+}
+
+// migrations lists every version of the schema, in order and numbered from
+// 1 without gaps.
+var migrations = []migration{
+	// The schema of every release from before migrations were recorded,
+	// which databases from then already have.
+	{1, "initial schema", sqlMigration(`
+		CREATE TABLE IF NOT EXISTS user (
+			_id TEXT PRIMARY KEY,
+			email TEXT UNIQUE
+		);
+		CREATE INDEX IF NOT EXISTS email_index ON user(email);
+
+		CREATE TABLE IF NOT EXISTS buffer (
+			_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			time INTEGER NOT NULL,
+			ttl INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			data BLOB,
+			FOREIGN KEY (user_id) REFERENCES user(_id)
+		);
+		CREATE INDEX IF NOT EXISTS userid_index ON buffer(user_id);
+	`)},
+	{2, "keep clip history", sqlMigration(`
+		CREATE TABLE setting (
+			user_id TEXT PRIMARY KEY,
+			history_depth INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user(_id)
+		);
+	`)},
+	{3, "register devices", sqlMigration(`
+		CREATE TABLE device (
+			_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			last_seen INTEGER NOT NULL,
+			revoked INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES user(_id)
+		);
+		CREATE INDEX device_userid_index ON device(user_id);
+	`)},
+	{4, "encrypt clips", sqlMigration(`
+		ALTER TABLE buffer ADD COLUMN encryption TEXT NOT NULL DEFAULT '';
+	`)},
+	{5, "pick clip lifetimes", sqlMigration(`
+		ALTER TABLE setting ADD COLUMN lifetime INTEGER;
+	`)},
+	{6, "upload clips in chunks", sqlMigration(`
+		CREATE TABLE upload (
+			_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			encryption TEXT NOT NULL DEFAULT '',
+			lifetime INTEGER NOT NULL DEFAULT 0,
+			size INTEGER NOT NULL,
+			chunk_size INTEGER NOT NULL,
+			state TEXT NOT NULL DEFAULT 'open',
+			created INTEGER NOT NULL,
+			updated INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES user(_id)
+		);
+		CREATE INDEX upload_updated_index ON upload(updated);
+
+		CREATE TABLE upload_chunk (
+			upload_id TEXT NOT NULL,
+			idx INTEGER NOT NULL,
+			start INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			checksum TEXT NOT NULL,
+			PRIMARY KEY (upload_id, idx),
+			FOREIGN KEY (upload_id) REFERENCES upload(_id)
+		);
+	`)},
+	// The triggers keep blob.refs in step with the clips referring to each
+	// blob, however the clips get deleted.
+	{7, "store payloads once as blobs", sqlMigration(`
+		CREATE TABLE blob (
+			user_id TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			refs INTEGER NOT NULL DEFAULT 0,
+			updated INTEGER NOT NULL,
+			PRIMARY KEY (user_id, hash),
+			FOREIGN KEY (user_id) REFERENCES user(_id)
+		);
+		CREATE INDEX blob_refs_index ON blob(refs, updated);
+
+		ALTER TABLE buffer ADD COLUMN hash TEXT;
+
+		CREATE TRIGGER buffer_blob_ref AFTER INSERT ON buffer
+		WHEN NEW.hash IS NOT NULL
+		BEGIN
+			UPDATE blob SET refs = refs + 1, updated = unixepoch()
+			WHERE user_id = NEW.user_id AND hash = NEW.hash;
+		END;
+		CREATE TRIGGER buffer_blob_unref AFTER DELETE ON buffer
+		WHEN OLD.hash IS NOT NULL
+		BEGIN
+			UPDATE blob SET refs = refs - 1, updated = unixepoch()
+			WHERE user_id = OLD.user_id AND hash = OLD.hash;
+		END;
+	`)},
+	// where the sqlite storage backend keeps payloads
+	{8, "add payload storage", sqlMigration(`
+		CREATE TABLE payload (
+			key TEXT PRIMARY KEY,
+			data BLOB NOT NULL
+		);
+	`)},
+	{9, "move clip payloads to storage", moveClipPayloads},
+	// refresh tokens are kept after use until they expire, to notice reuse
+	{10, "add sessions with refresh tokens", sqlMigration(`
+		CREATE TABLE session (
+			_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			last_used INTEGER NOT NULL,
+			revoked INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES user(_id),
+			FOREIGN KEY (device_id) REFERENCES device(_id)
+		);
+		CREATE INDEX session_deviceid_index ON session(device_id);
+
+		CREATE TABLE refresh_token (
+			hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			expires INTEGER NOT NULL,
+			used INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (session_id) REFERENCES session(_id)
+		);
+		CREATE INDEX refresh_token_sessionid_index ON refresh_token(session_id);
+	`)},
+	{11, "add personal access tokens", sqlMigration(`
+		CREATE TABLE personal_token (
+			_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			scopes TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			expires INTEGER,
+			last_used INTEGER,
+			revoked INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES user(_id)
+		);
+		CREATE INDEX personal_token_userid_index ON personal_token(user_id);
+	`)},
+	{12, "add quotas", sqlMigration(`
+		CREATE TABLE quota (
+			user_id TEXT PRIMARY KEY,
+			storage INTEGER,
+			clips INTEGER,
+			daily_upload INTEGER,
+			FOREIGN KEY (user_id) REFERENCES user(_id)
+		);
+
+		CREATE TABLE upload_volume (
+			user_id TEXT NOT NULL,
+			day INTEGER NOT NULL,
+			bytes INTEGER NOT NULL,
+			PRIMARY KEY (user_id, day),
+			FOREIGN KEY (user_id) REFERENCES user(_id)
+		);
+	`)},
+	{13, "disable users", sqlMigration(`
+		ALTER TABLE user ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+	`)},
+	{14, "index clips by user and time", sqlMigration(`
+		CREATE INDEX buffer_userid_time_index ON buffer(user_id, time);
+		DROP INDEX userid_index;
+	`)},
+	{15, "pin client certificates to devices", sqlMigration(`
+		ALTER TABLE device ADD COLUMN cert_fingerprint TEXT;
+		ALTER TABLE device ADD COLUMN cert_session_id TEXT;
+		CREATE UNIQUE INDEX device_cert_fingerprint_index ON device(cert_fingerprint) WHERE cert_fingerprint IS NOT NULL;
+	`)},
+	// Versions used to be the time of the newest clip, so counting starts
+	// past those that clients may still hold.
+	{16, "count buffer versions", sqlMigration(`
+		ALTER TABLE user ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+		UPDATE user SET version = unixepoch();
+	`)},
+}
+
+// moveClipPayloads turns the payloads of clips from before blobs, kept
+// inline in buffer.data, into blobs in storage.
+func moveClipPayloads(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT _id FROM buffer WHERE data IS NOT NULL AND hash IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// one at a time, so only one payload is in memory
+	for _, id := range ids {
+		var userid string
+		var data []byte
+		err := tx.QueryRowContext(ctx, `SELECT user_id, data FROM buffer WHERE _id = ?`, id).Scan(&userid, &data)
+		if err != nil {
+			return err
+		}
+
+		hash := handlers.HashBlob(data)
+		if err := movePayload(ctx, tx, storage.BlobKey(userid, hash), data); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO blob (user_id, hash, size, refs, updated)
+			VALUES (?, ?, ?, 0, unixepoch())
+			ON CONFLICT (user_id, hash) DO NOTHING`,
+			userid, hash, len(data))
+		if err != nil {
+			return err
+		}
+
+		// the triggers only count clips as they're inserted and deleted
+		_, err = tx.ExecContext(ctx, `UPDATE blob SET refs = refs + 1 WHERE user_id = ? AND hash = ?`, userid, hash)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE buffer SET hash = ?, data = NULL WHERE _id = ?`, hash, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE buffer DROP COLUMN data`); err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		slog.Info("moved clip payloads to storage", "count", len(ids))
+	}
+	return nil
+}
+
+// dryRunKey marks the context of migrations applied by a dry run.
+type dryRunKey struct{}
+
+// movePayload stores a payload a migration moves out of the database. The
+// sqlite backend stores it in tx along with the rest of the migration. The
+// other backends store it right away, except in a dry run, which mustn't
+// change anything; should the migration fail after that, the payload is
+// only wasted space until it's stored again on the next try.
+func movePayload(ctx context.Context, tx *sql.Tx, key string, data []byte) error {
+	if ctx.Value(dryRunKey{}) != nil && !storage.InDatabase() {
+		return nil
+	}
+	return storage.PutTx(ctx, tx, key, data)
+}
+
+// ErrNewerSchema means the database was migrated by a newer version of the
+// backend, whose schema this one doesn't know how to use.
+var ErrNewerSchema = errors.New("database schema is newer than this backend")
+
+// latestVersion is the schema version the backend works with.
+func latestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schema_version records the migrations applied. It's created along with
+// the first one, so even that leaves nothing behind when rolled back.
+const schemaVersionSchema = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied INTEGER NOT NULL
+	)`
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// schemaVersion returns the version of the schema, which is 0 before any
+// migration ran.
+func schemaVersion(ctx context.Context, q queryer) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type='table' AND name='schema_version'").Scan(&count)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+
+	var version int
+	err = q.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// Migrate applies the migrations the database hasn't had yet, each in its
+// own transaction along with recording its version in schema_version. With
+// dryRun set, they're applied in a single transaction which is then rolled
+// back, which shows whether they'd go through without changing anything.
+//
+// It fails with ErrNewerSchema rather than touch a database at a version it
+// doesn't know.
+func Migrate(ctx context.Context, dryRun bool) error {
+	current, err := schemaVersion(ctx, common.Db)
+	if err != nil {
+		return fmt.Errorf("[error] getting schema version: %w", err)
+	}
+
+	if current > latestVersion() {
+		return fmt.Errorf("%w: database is at version %d, backend supports up to %d", ErrNewerSchema, current, latestVersion())
+	}
+
+	if current == latestVersion() {
+		slog.Info("database schema is up to date", "version", current)
+		return nil
+	}
+
+	if dryRun {
+		return dryRunMigrations(ctx, current)
+	}
+
+	for _, m := range migrations[current:] {
+		if err := applyMigration(ctx, m); err != nil {
+			return fmt.Errorf("[error] migrating to version %d (%s): %w", m.version, m.name, err)
+		}
+		slog.Info("migrated database", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, m migration) (err error) {
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// another instance may have got here first
+	current, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if current >= m.version {
+		return tx.Commit()
+	}
+
+	if _, err = tx.ExecContext(ctx, schemaVersionSchema); err != nil {
+		return err
+	}
+
+	if err = m.up(ctx, tx); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_version (version, name, applied) VALUES (?, ?, unixepoch())`, m.version, m.name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func dryRunMigrations(ctx context.Context, current int) error {
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ctx = context.WithValue(ctx, dryRunKey{}, true)
+	for _, m := range migrations[current:] {
+		if err := m.up(ctx, tx); err != nil {
+			return fmt.Errorf("[error] migration to version %d (%s) would fail: %w", m.version, m.name, err)
+		}
+		slog.Info("would migrate database", "version", m.version, "name", m.name)
+	}
+	return nil
+}
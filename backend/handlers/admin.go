@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"harmony/backend/common"
+	"harmony/backend/storage"
+	"log/slog"
+)
+
+// UserSummary is what operators see of an account.
+type UserSummary struct {
+	Id       string `json:"id"`
+	Email    string `json:"email"`
+	Disabled bool   `json:"disabled"`
+	Clips    int64  `json:"clips"`
+	Storage  int64  `json:"storage"` // bytes of payloads stored
+	Devices  int64  `json:"devices"` // not revoked
+}
+
+// userSummaryQuery counts clips and storage the way GetUsage does, so
+// operators see the numbers quotas are enforced against.
+const userSummaryQuery = `
+	SELECT
+		u._id, u.email, u.disabled,
+		(SELECT COUNT(*) FROM buffer WHERE user_id = u._id AND ttl >= unixepoch()),
+		(SELECT COALESCE(SUM(size), 0) FROM blob WHERE user_id = u._id AND refs > 0),
+		(SELECT COUNT(*) FROM device WHERE user_id = u._id AND revoked = 0)
+	FROM user u`
+
+func scanUserSummary(scan func(dest ...any) error) (*UserSummary, error) {
+	var u UserSummary
+	err := scan(&u.Id, &u.Email, &u.Disabled, &u.Clips, &u.Storage, &u.Devices)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListUsers returns a page of accounts in the order they signed up, and how
+// many there are in total.
+func ListUsers(ctx context.Context, offset int, limit int) ([]UserSummary, int, error) {
+	var total int
+	err := common.Db.QueryRowContext(ctx, `SELECT COUNT(*) FROM user`).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := common.Db.QueryContext(ctx, userSummaryQuery+`
+		ORDER BY u.rowid
+		LIMIT ? OFFSET ?`,
+		limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		u, err := scanUserSummary(rows.Scan)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, *u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+func GetUserSummary(ctx context.Context, userid string) (*UserSummary, error) {
+	row := common.Db.QueryRowContext(ctx, userSummaryQuery+`
+		WHERE u._id = ?`,
+		userid)
+
+	u, err := scanUserSummary(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoUser
+	}
+	return u, err
+}
+
+// SetUserDisabled disables an account, which turns away everything it
+// signs in or authenticates with until it's enabled again.
+func SetUserDisabled(ctx context.Context, userid string, disabled bool) error {
+	res, err := common.Db.ExecContext(ctx, `UPDATE user SET disabled = ? WHERE _id = ?`, disabled, userid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoUser
+	}
+	return nil
+}
+
+// RevokedAccess counts what RevokeUserAccess took away.
+type RevokedAccess struct {
+	Sessions     int64 `json:"sessions"`
+	Tokens       int64 `json:"tokens"`
+	Certificates int64 `json:"certificates"`
+}
+
+// RevokeUserAccess signs every one of the user's devices out, revokes their
+// personal access tokens and unpins their devices' client certificates, all
+// at once. The devices stay registered and may sign in again.
+func RevokeUserAccess(ctx context.Context, userid string) (*RevokedAccess, error) {
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var r RevokedAccess
+	for _, q := range []struct {
+		query string
+		count *int64
+	}{
+		{`UPDATE session SET revoked = 1 WHERE user_id = ? AND revoked = 0`, &r.Sessions},
+		{`UPDATE personal_token SET revoked = 1 WHERE user_id = ? AND revoked = 0`, &r.Tokens},
+		{`UPDATE device SET cert_fingerprint = NULL, cert_session_id = NULL WHERE user_id = ? AND cert_fingerprint IS NOT NULL`, &r.Certificates},
+	} {
+		var res sql.Result
+		res, err = tx.ExecContext(ctx, q.query, userid)
+		if err != nil {
+			return nil, err
+		}
+		if *q.count, err = res.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// DeleteUser deletes an account and everything that belongs to it,
+// including the payloads in storage.
+func DeleteUser(ctx context.Context, userid string) error {
+	ctx = context.WithoutCancel(ctx)
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// children before the rows they refer to
+	for _, q := range []string{
+		`DELETE FROM refresh_token WHERE session_id IN (SELECT _id FROM session WHERE user_id = ?)`,
+		`DELETE FROM session WHERE user_id = ?`,
+		`DELETE FROM personal_token WHERE user_id = ?`,
+		`DELETE FROM upload_chunk WHERE upload_id IN (SELECT _id FROM upload WHERE user_id = ?)`,
+		`DELETE FROM upload_volume WHERE user_id = ?`,
+		`DELETE FROM quota WHERE user_id = ?`,
+		`DELETE FROM setting WHERE user_id = ?`,
+		`DELETE FROM buffer WHERE user_id = ?`,
+		`DELETE FROM device WHERE user_id = ?`,
+	} {
+		if _, err = tx.ExecContext(ctx, q, userid); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, `DELETE FROM upload WHERE user_id = ? RETURNING _id, size, chunk_size`, userid)
+	if err != nil {
+		return err
+	}
+
+	var uploads []Upload
+	for rows.Next() {
+		var u Upload
+		if err = rows.Scan(&u.Id, &u.Size, &u.ChunkSize); err != nil {
+			rows.Close()
+			return err
+		}
+		uploads = append(uploads, u)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.QueryContext(ctx, `DELETE FROM blob WHERE user_id = ? RETURNING hash`, userid)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, storage.BlobKey(userid, hash))
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM user WHERE _id = ?`, userid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		err = ErrNoUser
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// the account is gone either way, a payload left behind is only wasted
+	// space
+	for _, key := range keys {
+		if err := storage.Delete(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "deleting payload of deleted user", "key", key, "error", err)
+		}
+	}
+	for i := range uploads {
+		deleteChunks(ctx, &uploads[i])
+	}
+
+	return nil
+}
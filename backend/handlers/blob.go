@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"harmony/backend/common"
+	"harmony/backend/storage"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Clip payloads are stored once per user, keyed by the SHA-256 of the bytes,
+// and clips refer to them by that hash. The blob table keeps each payload's
+// size and how many clips refer to it, while the bytes themselves live in
+// the storage backend. The refs count is kept by triggers on the buffer
+// table, and CollectBlobs drops blobs nothing has referred to for a while.
+
+var ErrNoBlob = errors.New("no blob found")
+
+// blobMu keeps CollectBlobs from deleting a blob between a new clip finding
+// it and referring to it.
+var blobMu sync.RWMutex
+
+// HashBlob returns the hex SHA-256 a payload is stored under.
+func HashBlob(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// GetBlobSize reports the size of the user's blob with the given hash.
+func GetBlobSize(ctx context.Context, userid string, hash string) (int64, error) {
+	var size int64
+	err := common.Db.QueryRowContext(ctx, `
+		SELECT size
+		FROM blob
+		WHERE user_id = ? AND hash = ?`,
+		userid, hash).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoBlob
+	}
+	return size, err
+}
+
+// getPayload loads a clip's payload. Clips without a hash are empty.
+func getPayload(ctx context.Context, userid string, hash string) ([]byte, error) {
+	if hash == "" {
+		return []byte{}, nil
+	}
+
+	data, err := storage.Get(ctx, storage.BlobKey(userid, hash))
+	if err == storage.ErrNotFound {
+		return nil, ErrNoBlob
+	}
+	return data, err
+}
+
+// putBlob records a blob unless the user already has one with its hash.
+// The payload must already be in storage.
+func putBlob(ctx context.Context, tx *sql.Tx, userid string, hash string, size int64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO blob (user_id, hash, size, refs, updated)
+		VALUES (?, ?, ?, 0, ?)
+		ON CONFLICT (user_id, hash) DO NOTHING`,
+		userid, hash, size, time.Now().Unix())
+	return err
+}
+
+// CollectBlobs deletes the blobs no clip has referred to since before, and
+// returns how many it deleted. Payloads that fail to be deleted from
+// storage are logged and left behind, as are the rest once ctx is done.
+func CollectBlobs(ctx context.Context, before time.Time) (int, error) {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	rows, err := common.Db.QueryContext(ctx, `
+		DELETE FROM blob
+		WHERE refs <= 0 AND updated < ?
+		RETURNING user_id, hash`,
+		before.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	for rows.Next() {
+		var userid, hash string
+		if err := rows.Scan(&userid, &hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, storage.BlobKey(userid, hash))
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// a payload left behind by a failed delete is only wasted space
+	for _, key := range keys {
+		if err := storage.Delete(ctx, key); ctx.Err() != nil {
+			return len(keys), ctx.Err()
+		} else if err != nil {
+			slog.ErrorContext(ctx, "deleting payload of unreferenced blob", "key", key, "error", err)
+		}
+	}
+
+	return len(keys), nil
+}
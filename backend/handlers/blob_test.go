@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"harmony/backend/common"
+	"harmony/backend/storage"
+	"slices"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// fakeStore keeps payloads in memory, and fails to delete the keys in
+// failDelete.
+type fakeStore struct {
+	data       map[string][]byte
+	failDelete map[string]bool
+}
+
+func (s *fakeStore) Put(ctx context.Context, key string, data []byte) error {
+	s.data[key] = data
+	return nil
+}
+
+func (s *fakeStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, ok := s.data[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *fakeStore) Delete(ctx context.Context, key string) error {
+	if s.failDelete[key] {
+		return errors.New("delete failed")
+	}
+	delete(s.data, key)
+	return nil
+}
+
+func TestCollectBlobs(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	common.Db = db
+
+	_, err = db.Exec(`
+		CREATE TABLE blob (
+			user_id TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			refs INTEGER NOT NULL DEFAULT 0,
+			updated INTEGER NOT NULL,
+			PRIMARY KEY (user_id, hash)
+		)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	old := now.Add(-time.Hour).Unix()
+	blobs := []struct {
+		hash    string
+		refs    int
+		updated int64
+	}{
+		{"unreferenced", 0, old},
+		{"failing", 0, old},
+		{"also-unreferenced", 0, old},
+		{"referenced", 1, old},
+		{"recent", 0, now.Unix()},
+	}
+
+	fs := &fakeStore{data: map[string][]byte{}, failDelete: map[string]bool{storage.BlobKey("u", "failing"): true}}
+	storage.SetStore(fs)
+	for _, b := range blobs {
+		_, err := db.Exec(`INSERT INTO blob (user_id, hash, size, refs, updated) VALUES ('u', ?, 1, ?, ?)`, b.hash, b.refs, b.updated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.data[storage.BlobKey("u", b.hash)] = []byte("x")
+	}
+
+	n, err := CollectBlobs(context.Background(), now.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("CollectBlobs: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("CollectBlobs deleted %d blobs, want 3", n)
+	}
+
+	var left []string
+	rows, err := db.Query(`SELECT hash FROM blob ORDER BY hash`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, hash)
+	}
+	rows.Close()
+	if want := []string{"recent", "referenced"}; !slices.Equal(left, want) {
+		t.Errorf("blobs left: got %v, want %v", left, want)
+	}
+
+	// a payload that failed to be deleted mustn't keep the rest from going
+	for _, hash := range []string{"unreferenced", "also-unreferenced"} {
+		if _, ok := fs.data[storage.BlobKey("u", hash)]; ok {
+			t.Errorf("payload of %s wasn't deleted", hash)
+		}
+	}
+	for _, hash := range []string{"failing", "referenced", "recent"} {
+		if _, ok := fs.data[storage.BlobKey("u", hash)]; !ok {
+			t.Errorf("payload of %s was deleted", hash)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"harmony/backend/common"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// lastSeenResolution bounds how often a device's last_seen gets written, so
+// that authenticated requests, which mostly only read, don't each turn into
+// a database write contending for SQLite's single writer.
+const lastSeenResolution = 5 * time.Minute
+
+type Device struct {
+	Id       string `json:"id"`
+	UserId   string `json:"-"`
+	Name     string `json:"name"`
+	Created  int64  `json:"created"`
+	LastSeen int64  `json:"last_seen"`
+	Revoked  bool   `json:"revoked"`
+
+	// CertFingerprint is the SHA-256 of the client certificate pinned to
+	// the device, hex encoded, if there is one.
+	CertFingerprint string `json:"cert_fingerprint,omitempty"`
+	// CertSessionId is the session the certificate was pinned under. The
+	// certificate only signs the device in while that session lasts.
+	CertSessionId string `json:"-"`
+}
+
+var (
+	ErrNoDevice      = errors.New("no device found")
+	ErrDeviceRevoked = errors.New("device revoked")
+)
+
+// RegisterDevice returns the id the user's device signs in with. A device
+// that already has an id keeps it, unless it has been revoked since, in
+// which case it's registered anew.
+func RegisterDevice(ctx context.Context, userid string, deviceid string, name string) (string, error) {
+	now := time.Now().Unix()
+
+	if deviceid != "" {
+		res, err := common.Db.ExecContext(ctx, `
+			UPDATE device
+			SET name = ?, last_seen = ?
+			WHERE _id = ? AND user_id = ? AND revoked = 0`,
+			name, now, deviceid, userid)
+		if err != nil {
+			return "", err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return "", err
+		}
+		if n > 0 {
+			return deviceid, nil
+		}
+	}
+
+	_id := uuid.New().String()
+	_, err := common.Db.ExecContext(ctx, `
+		INSERT INTO device (_id, user_id, name, created, last_seen)
+		VALUES (?, ?, ?, ?, ?)`,
+		_id, userid, name, now, now)
+	if err != nil {
+		return "", err
+	}
+
+	return _id, nil
+}
+
+// CheckDevice fails unless the device is registered to the user and hasn't
+// been revoked, and records that the device was seen.
+func CheckDevice(ctx context.Context, userid string, deviceid string) error {
+	var revoked bool
+	var lastSeen int64
+
+	err := common.Db.QueryRowContext(ctx, `
+		SELECT revoked, last_seen
+		FROM device
+		WHERE _id = ? AND user_id = ?`,
+		deviceid, userid).Scan(&revoked, &lastSeen)
+	if err == sql.ErrNoRows {
+		return ErrNoDevice
+	} else if err != nil {
+		return err
+	}
+
+	if revoked {
+		return ErrDeviceRevoked
+	}
+
+	// last_seen is only informational, so failing to record it doesn't
+	// fail the request; a request racing this one may have written it
+	// already
+	now := time.Now()
+	if now.Sub(time.Unix(lastSeen, 0)) >= lastSeenResolution {
+		_, err = common.Db.ExecContext(ctx, `
+			UPDATE device SET last_seen = ?
+			WHERE _id = ? AND last_seen = ?`,
+			now.Unix(), deviceid, lastSeen)
+		if err != nil {
+			slog.WarnContext(ctx, "recording when the device was last seen", "device_id", deviceid, "error", err)
+		}
+	}
+
+	return nil
+}
+
+func ListDevices(ctx context.Context, userid string) ([]Device, error) {
+	rows, err := common.Db.QueryContext(ctx, `
+		SELECT _id, name, created, last_seen, revoked, COALESCE(cert_fingerprint, '')
+		FROM device
+		WHERE user_id = ?
+		ORDER BY last_seen DESC`,
+		userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.Id, &d.Name, &d.Created, &d.LastSeen, &d.Revoked, &d.CertFingerprint); err != nil {
+			return nil, err
+		}
+		d.UserId = userid
+		devices = append(devices, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// RevokeDevice signs the device out for good, ending its sessions.
+func RevokeDevice(ctx context.Context, userid string, deviceid string) error {
+	res, err := common.Db.ExecContext(ctx, `
+		UPDATE device
+		SET revoked = 1
+		WHERE _id = ? AND user_id = ?`,
+		deviceid, userid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoDevice
+	}
+
+	_, err = common.Db.ExecContext(ctx, `UPDATE session SET revoked = 1 WHERE device_id = ?`, deviceid)
+	return err
+}
+
+// ErrCertificateInUse means the client certificate is pinned to another
+// device already.
+var ErrCertificateInUse = errors.New("certificate pinned to another device")
+
+// SetDeviceCertificate pins the client certificate with the fingerprint to
+// the user's device, which then signs in by presenting it for as long as
+// the session it's pinned under isn't revoked. An empty fingerprint unpins
+// the device's certificate.
+func SetDeviceCertificate(ctx context.Context, userid string, deviceid string, sessionid string, fingerprint string) error {
+	var fp, sid any
+	if fingerprint != "" {
+		d, err := GetDeviceByCertificate(ctx, fingerprint)
+		if err != nil && err != ErrNoDevice {
+			return err
+		}
+		if err == nil && d.Id != deviceid {
+			// a certificate pinned under a session that has ended no
+			// longer signs anyone in, and may be pinned anew
+			err = CheckSession(ctx, d.CertSessionId)
+			if err == nil {
+				return ErrCertificateInUse
+			} else if err != ErrNoSession && err != ErrSessionRevoked {
+				return err
+			}
+
+			_, err = common.Db.ExecContext(ctx, `
+				UPDATE device
+				SET cert_fingerprint = NULL, cert_session_id = NULL
+				WHERE _id = ? AND cert_fingerprint = ?`,
+				d.Id, fingerprint)
+			if err != nil {
+				return err
+			}
+		}
+		fp, sid = fingerprint, sessionid
+	}
+
+	res, err := common.Db.ExecContext(ctx, `
+		UPDATE device
+		SET cert_fingerprint = ?, cert_session_id = ?
+		WHERE _id = ? AND user_id = ? AND revoked = 0`,
+		fp, sid, deviceid, userid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoDevice
+	}
+	return nil
+}
+
+// GetDeviceByCertificate returns the device the client certificate with the
+// fingerprint is pinned to. Whether it's still signed in is up to
+// CheckDevice and CheckSession.
+func GetDeviceByCertificate(ctx context.Context, fingerprint string) (*Device, error) {
+	d := Device{CertFingerprint: fingerprint}
+	err := common.Db.QueryRowContext(ctx, `
+		SELECT _id, user_id, name, created, last_seen, revoked, COALESCE(cert_session_id, '')
+		FROM device
+		WHERE cert_fingerprint = ?`,
+		fingerprint).Scan(&d.Id, &d.UserId, &d.Name, &d.Created, &d.LastSeen, &d.Revoked, &d.CertSessionId)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoDevice
+	} else if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
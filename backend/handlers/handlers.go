@@ -1,87 +1,200 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"harmony/backend/common"
+	"harmony/backend/storage"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// BufType is the MIME type of a clip's contents.
 type BufType string
 
 const (
-	TextType  BufType = "text"
-	ImageType BufType = "image"
+	TextType  BufType = "text/plain"
+	ImageType BufType = "image/png"
 )
 
 type User struct {
-	Id    string
-	Email string
+	Id       string
+	Email    string
+	Disabled bool
 }
 
+// Buffer is a single clip. When Encryption is set, Data is ciphertext the
+// server can't read, produced by the client with the named scheme.
 type Buffer struct {
-	Id     string
-	UserId string
-	Time   int64
-	Ttl    int64
-	Type   BufType
-	Data   []byte
+	Id         string  `json:"id"`
+	UserId     string  `json:"-"`
+	Time       int64   `json:"time"`
+	Ttl        int64   `json:"ttl"`
+	Type       BufType `json:"type"`
+	Encryption string  `json:"encryption,omitempty"`
+	Hash       string  `json:"hash,omitempty"`
+	Size       int64   `json:"size"`
+	Data       []byte  `json:"-"`
+	// Version is that of the user's buffer as of this clip; see GetVersion.
+	Version int64 `json:"-"`
 }
 
-func GetBuffer(userid string) ([]byte, BufType, int64, error) {
+var ErrNoBuffer = errors.New("no buffer found")
+
+var (
+	ErrNoUser       = errors.New("no user found")
+	ErrUserDisabled = errors.New("user disabled")
+)
+
+// parseBufType maps the bare types older clips were stored with to MIME
+// types.
+func parseBufType(t string) BufType {
+	switch t {
+	case "text":
+		return TextType
+	case "image":
+		return ImageType
+	}
+	return BufType(t)
+}
+
+// GetBuffer returns the user's newest clip that hasn't expired yet. Clips
+// can have different lifetimes, so that isn't necessarily the newest clip.
+func GetBuffer(ctx context.Context, userid string) (*Buffer, error) {
 	query := `
-		SELECT data, type, ttl
+		SELECT _id, time, ttl, type, encryption, coalesce(hash, ''),
+			(SELECT version FROM user WHERE _id = buffer.user_id)
 		FROM buffer
-		WHERE user_id = ?
-		ORDER BY time DESC
+		WHERE user_id = ? AND ttl >= unixepoch()
+		ORDER BY time DESC, rowid DESC
 		LIMIT 1`
 
-	var data []byte
+	var b Buffer
 	var bufType string
-	var ttl int64
 
-	err := common.Db.QueryRow(query, userid).Scan(&data, &bufType, &ttl)
+	err := common.Db.QueryRowContext(ctx, query, userid).Scan(&b.Id, &b.Time, &b.Ttl, &bufType, &b.Encryption, &b.Hash, &b.Version)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, TextType, 0, fmt.Errorf("no buffer found")
+			return nil, ErrNoBuffer
 		}
-		return nil, TextType, 0, err
+		return nil, err
+	}
+
+	b.Data, err = getPayload(ctx, userid, b.Hash)
+	if err != nil {
+		return nil, err
 	}
 
-	if time.Now().Unix() > ttl {
-		return nil, TextType, 0, fmt.Errorf("buffer expired")
+	b.UserId = userid
+	b.Type = parseBufType(bufType)
+	b.Size = int64(len(b.Data))
+	return &b, nil
+}
+
+func GetBufferById(ctx context.Context, userid string, id string) (*Buffer, error) {
+	query := `
+		SELECT _id, time, ttl, type, encryption, coalesce(hash, ''),
+			(SELECT version FROM user WHERE _id = buffer.user_id)
+		FROM buffer
+		WHERE _id = ? AND user_id = ? AND ttl >= unixepoch()`
+
+	var b Buffer
+	var bufType string
+
+	err := common.Db.QueryRowContext(ctx, query, id, userid).Scan(&b.Id, &b.Time, &b.Ttl, &bufType, &b.Encryption, &b.Hash, &b.Version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoBuffer
+		}
+		return nil, err
 	}
 
-	bt := TextType
-	if bufType == string(ImageType) {
-		bt = ImageType
+	b.Data, err = getPayload(ctx, userid, b.Hash)
+	if err != nil {
+		return nil, err
 	}
 
-	return data, bt, ttl, nil
+	b.UserId = userid
+	b.Type = parseBufType(bufType)
+	b.Size = int64(len(b.Data))
+	return &b, nil
 }
 
-func UpsertBuffer(userid string, data []byte, t BufType) (int64, error) {
-	// Check if a buffer already exists for this user
-	var existingId string
-	query := `SELECT _id FROM buffer WHERE user_id = ? LIMIT 1`
-	err := common.Db.QueryRow(query, userid).Scan(&existingId)
+// ListBuffers returns one page of the user's unexpired clips, newest first,
+// without their payloads, along with the total number of unexpired clips.
+func ListBuffers(ctx context.Context, userid string, offset int, limit int) ([]Buffer, int, error) {
+	var total int
+	err := common.Db.QueryRowContext(ctx, `
+		SELECT count(*)
+		FROM buffer
+		WHERE user_id = ? AND ttl >= unixepoch()`,
+		userid).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	var _id string
-	if err == nil {
-		_id = existingId
-	} else if err == sql.ErrNoRows {
-		_id = uuid.New().String()
-	} else {
-		return 0, err
+	rows, err := common.Db.QueryContext(ctx, `
+		SELECT b._id, b.time, b.ttl, b.type, b.encryption, coalesce(b.hash, ''), coalesce(blob.size, 0)
+		FROM buffer b
+		LEFT JOIN blob ON blob.user_id = b.user_id AND blob.hash = b.hash
+		WHERE b.user_id = ? AND b.ttl >= unixepoch()
+		ORDER BY b.time DESC, b.rowid DESC
+		LIMIT ? OFFSET ?`,
+		userid, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	buffers := []Buffer{}
+	for rows.Next() {
+		var b Buffer
+		var bufType string
+		if err := rows.Scan(&b.Id, &b.Time, &b.Ttl, &bufType, &b.Encryption, &b.Hash, &b.Size); err != nil {
+			return nil, 0, err
+		}
+		b.UserId = userid
+		b.Type = parseBufType(bufType)
+		buffers = append(buffers, b)
 	}
 
-	ttl := time.Now().Add(common.Lifetime).Unix()
-	currentTime := time.Now().Unix()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
 
-	// Use a transaction to ensure atomicity
-	tx, err := common.Db.Begin()
+	return buffers, total, nil
+}
+
+// GetVersion returns the version of the user's buffer, which goes up with
+// every clip added, deleted or cleared, so clients can tell whether they
+// have the latest. Clips expiring don't change it.
+func GetVersion(ctx context.Context, userid string) (int64, error) {
+	var version int64
+	err := common.Db.QueryRowContext(ctx, `SELECT version FROM user WHERE _id = ?`, userid).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoUser
+	}
+	return version, err
+}
+
+// bumpVersion moves the user's buffer on to its next version, as part of
+// the change made in tx.
+func bumpVersion(ctx context.Context, tx *sql.Tx, userid string) (int64, error) {
+	var version int64
+	err := tx.QueryRowContext(ctx, `
+		UPDATE user SET version = version + 1
+		WHERE _id = ?
+		RETURNING version`,
+		userid).Scan(&version)
+	return version, err
+}
+
+// DeleteBuffer deletes one of the user's clips and returns the version of
+// the buffer without it.
+func DeleteBuffer(ctx context.Context, userid string, id string) (int64, error) {
+	tx, err := common.Db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -91,19 +204,21 @@ func UpsertBuffer(userid string, data []byte, t BufType) (int64, error) {
 		}
 	}()
 
-	if existingId != "" {
-		_, err = tx.Exec(`
-			UPDATE buffer
-			SET data = ?, time = ?, ttl = ?, type = ?
-			WHERE _id = ?`,
-			data, currentTime, ttl, string(t), _id)
-	} else {
-		_, err = tx.Exec(`
-			INSERT INTO buffer (_id, user_id, time, ttl, type, data)
-			VALUES (?, ?, ?, ?, ?, ?)`,
-			_id, userid, currentTime, ttl, string(t), data)
+	res, err := tx.ExecContext(ctx, `DELETE FROM buffer WHERE _id = ? AND user_id = ?`, id, userid)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		err = ErrNoBuffer
+		return 0, err
 	}
 
+	version, err := bumpVersion(ctx, tx, userid)
 	if err != nil {
 		return 0, err
 	}
@@ -112,13 +227,255 @@ func UpsertBuffer(userid string, data []byte, t BufType) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	return version, nil
+}
+
+// ClearBuffers deletes all of the user's clips, and returns how many there
+// were along with the version of the emptied buffer.
+func ClearBuffers(ctx context.Context, userid string) (int64, int64, error) {
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM buffer WHERE user_id = ?`, userid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	version, err := bumpVersion(ctx, tx, userid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, version, nil
+}
+
+// UpsertBuffer stores data as the user's newest clip and trims the user's
+// history down to their configured depth. enc names the scheme the client
+// encrypted data with, if any. The clip lives for lifetime, or for the
+// user's default lifetime when that's zero. The payload itself is only
+// stored if the user has no blob with the same hash yet. The bytes of data
+// count toward the user's daily upload volume once the clip is stored.
+func UpsertBuffer(ctx context.Context, userid string, data []byte, t BufType, enc string, lifetime time.Duration) (*Buffer, error) {
+	return insertBuffer(ctx, userid, HashBlob(data), data, t, enc, lifetime)
+}
+
+// UpsertBufferByHash is UpsertBuffer for a payload the server already has,
+// failing with ErrNoBlob when it doesn't.
+func UpsertBufferByHash(ctx context.Context, userid string, hash string, t BufType, enc string, lifetime time.Duration) (*Buffer, error) {
+	return insertBuffer(ctx, userid, hash, nil, t, enc, lifetime)
+}
+
+func insertBuffer(ctx context.Context, userid string, hash string, data []byte, t BufType, enc string, lifetime time.Duration) (*Buffer, error) {
+	// a client going away mustn't interrupt storing the clip halfway, which
+	// could leave a payload behind that nothing refers to
+	ctx = context.WithoutCancel(ctx)
+
+	settings, err := GetSettings(ctx, userid)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBuffer(userid, hash, t, enc, lifetime, settings)
+	uploaded := int64(len(data))
+
+	blobMu.RLock()
+	defer blobMu.RUnlock()
+
+	_, err = GetBlobSize(ctx, userid, hash)
+	if data != nil && err == ErrNoBlob {
+		// check before storing, so a clip over quota leaves nothing behind
+		err = checkStoredQuota(ctx, userid, hash, int64(len(data)), settings.HistoryDepth)
+		if err == nil {
+			err = storage.Put(ctx, storage.BlobKey(userid, hash), data)
+		}
+	} else if err == nil {
+		err = checkStoredQuota(ctx, userid, hash, 0, settings.HistoryDepth)
+		if err == nil && data == nil {
+			data, err = getPayload(ctx, userid, hash)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.Data = data
+	b.Size = int64(len(data))
+
+	if err := addBuffer(ctx, &b, settings.HistoryDepth, uploaded); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// newBuffer starts a clip of the payload with the given hash, kept for
+// lifetime or else as long as the user's settings say.
+func newBuffer(userid string, hash string, t BufType, enc string, lifetime time.Duration, settings *Settings) Buffer {
+	if lifetime == 0 {
+		lifetime = time.Duration(settings.Lifetime) * time.Second
+	}
+
+	return Buffer{
+		Id:         uuid.New().String(),
+		UserId:     userid,
+		Time:       time.Now().Unix(),
+		Ttl:        time.Now().Add(lifetime).Unix(),
+		Type:       t,
+		Encryption: enc,
+		Hash:       hash,
+	}
+}
+
+// addBuffer records the clip b, whose payload is already in storage, and
+// drops the user's clips past the newest depth. The uploaded bytes the
+// clip came in are counted toward the user's daily upload volume along
+// with it, so clips that fail to be stored aren't charged for.
+func addBuffer(ctx context.Context, b *Buffer, depth int, uploaded int64) error {
+	var q *Quota
+	if uploaded > 0 {
+		var err error
+		q, err = GetQuota(ctx, b.UserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Use a transaction to ensure atomicity
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
 
-	return ttl, nil
+	if uploaded > 0 {
+		err = recordUpload(ctx, tx, b.UserId, uploaded, q)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = putBlob(ctx, tx, b.UserId, b.Hash, b.Size)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO buffer (_id, user_id, time, ttl, type, encryption, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		b.Id, b.UserId, b.Time, b.Ttl, string(b.Type), b.Encryption, b.Hash)
+	if err != nil {
+		return err
+	}
+
+	b.Version, err = bumpVersion(ctx, tx, b.UserId)
+	if err != nil {
+		return err
+	}
+
+	// Drop everything older than the newest `depth` clips
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM buffer
+		WHERE user_id = ? AND _id NOT IN (
+			SELECT _id FROM buffer
+			WHERE user_id = ?
+			ORDER BY time DESC, rowid DESC
+			LIMIT ?
+		)`,
+		b.UserId, b.UserId, depth)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Settings are the user's preferences. Lifetime is how long clips are kept
+// unless a client asks otherwise, in seconds.
+type Settings struct {
+	HistoryDepth int   `json:"history_depth"`
+	Lifetime     int64 `json:"lifetime"`
+}
+
+func GetSettings(ctx context.Context, userid string) (*Settings, error) {
+	s := Settings{
+		HistoryDepth: common.HistoryDepth,
+		Lifetime:     int64(common.Lifetime.Seconds()),
+	}
+
+	var lifetime sql.NullInt64
+	err := common.Db.QueryRowContext(ctx, `
+		SELECT history_depth, lifetime
+		FROM setting
+		WHERE user_id = ?`,
+		userid).Scan(&s.HistoryDepth, &lifetime)
+	if err == sql.ErrNoRows {
+		return &s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if lifetime.Valid {
+		s.Lifetime = lifetime.Int64
+	}
+	return &s, nil
+}
+
+func SaveSettings(ctx context.Context, userid string, s *Settings) error {
+	_, err := common.Db.ExecContext(ctx, `
+		INSERT INTO setting (user_id, history_depth, lifetime)
+		VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			history_depth = excluded.history_depth,
+			lifetime = excluded.lifetime`,
+		userid, s.HistoryDepth, s.Lifetime)
+	return err
+}
+
+func GetUser(ctx context.Context, userid string) (*User, error) {
+	u := User{Id: userid}
+	err := common.Db.QueryRowContext(ctx, `SELECT email, disabled FROM user WHERE _id = ?`, userid).Scan(&u.Email, &u.Disabled)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoUser
+	} else if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CheckUser fails unless the user exists and hasn't been disabled.
+func CheckUser(ctx context.Context, userid string) error {
+	u, err := GetUser(ctx, userid)
+	if err != nil {
+		return err
+	}
+
+	if u.Disabled {
+		return ErrUserDisabled
+	}
+	return nil
 }
 
-func CreateOrGetUser(email string) (string, error) {
+func CreateOrGetUser(ctx context.Context, email string) (string, error) {
 	var userId string
-	err := common.Db.QueryRow(`SELECT _id FROM user WHERE email = ?`, email).Scan(&userId)
+	err := common.Db.QueryRowContext(ctx, `SELECT _id FROM user WHERE email = ?`, email).Scan(&userId)
 
 	if err == nil {
 		return userId, nil
@@ -128,7 +485,7 @@ func CreateOrGetUser(email string) (string, error) {
 
 	uid := uuid.New().String()
 
-	tx, err := common.Db.Begin()
+	tx, err := common.Db.BeginTx(ctx, nil)
 	if err != nil {
 		return "", err
 	}
@@ -139,7 +496,7 @@ func CreateOrGetUser(email string) (string, error) {
 	}()
 
 	// Check again in transaction to handle race conditions
-	err = tx.QueryRow(`SELECT _id FROM user WHERE email = ?`, email).Scan(&userId)
+	err = tx.QueryRowContext(ctx, `SELECT _id FROM user WHERE email = ?`, email).Scan(&userId)
 	if err == nil {
 		// Another process created the user, return that ID
 		tx.Commit()
@@ -149,7 +506,7 @@ func CreateOrGetUser(email string) (string, error) {
 	}
 
 	// Create new user
-	_, err = tx.Exec(`INSERT INTO user (_id, email) VALUES (?, ?)`, uid, email)
+	_, err = tx.ExecContext(ctx, `INSERT INTO user (_id, email) VALUES (?, ?)`, uid, email)
 	if err != nil {
 		return "", err
 	}
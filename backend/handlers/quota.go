@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"harmony/backend/common"
+	"harmony/backend/config"
+	"time"
+)
+
+// Quotas cap how much a user may keep on the server and send to it. The
+// limits in DefaultQuota apply to everyone, and a row in the quota table
+// overrides any of them for one user. Zero means unlimited.
+type Quota struct {
+	Storage     int64 `json:"storage"`      // bytes of payloads stored
+	Clips       int64 `json:"clips"`        // clips kept
+	DailyUpload int64 `json:"daily_upload"` // bytes received per UTC day
+}
+
+var DefaultQuota = Quota{
+	Storage:     common.StorageQuota,
+	Clips:       common.ClipQuota,
+	DailyUpload: common.DailyUploadQuota,
+}
+
+// SetupQuotas sets the default quota from the config.
+func SetupQuotas(q config.Quota) {
+	DefaultQuota = Quota(q)
+}
+
+// QuotaError says which of the user's quotas a request would go over.
+type QuotaError struct {
+	Quota string
+	Limit int64
+}
+
+func (e *QuotaError) Error() string {
+	switch e.Quota {
+	case "storage":
+		return fmt.Sprintf("storage quota of %d bytes exceeded", e.Limit)
+	case "clips":
+		return fmt.Sprintf("quota of %d clips exceeded", e.Limit)
+	default:
+		return fmt.Sprintf("daily upload quota of %d bytes exceeded", e.Limit)
+	}
+}
+
+// Usage is how much of each quota the user has used.
+type Usage struct {
+	Storage     int64 `json:"storage"`
+	Clips       int64 `json:"clips"`
+	DailyUpload int64 `json:"daily_upload"`
+}
+
+// today numbers UTC days since the epoch, which daily upload volume is
+// counted by.
+func today() int64 {
+	return time.Now().Unix() / (24 * 60 * 60)
+}
+
+// GetQuota returns the user's quota, with their overrides applied.
+func GetQuota(ctx context.Context, userid string) (*Quota, error) {
+	q := DefaultQuota
+
+	var storage, clips, dailyUpload sql.NullInt64
+	err := common.Db.QueryRowContext(ctx, `
+		SELECT storage, clips, daily_upload
+		FROM quota
+		WHERE user_id = ?`,
+		userid).Scan(&storage, &clips, &dailyUpload)
+	if err == sql.ErrNoRows {
+		return &q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if storage.Valid {
+		q.Storage = storage.Int64
+	}
+	if clips.Valid {
+		q.Clips = clips.Int64
+	}
+	if dailyUpload.Valid {
+		q.DailyUpload = dailyUpload.Int64
+	}
+	return &q, nil
+}
+
+// SetQuota overrides the user's quotas. Nil fields fall back to the
+// defaults.
+func SetQuota(ctx context.Context, userid string, storage, clips, dailyUpload *int64) error {
+	_, err := common.Db.ExecContext(ctx, `
+		INSERT INTO quota (user_id, storage, clips, daily_upload)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			storage = excluded.storage,
+			clips = excluded.clips,
+			daily_upload = excluded.daily_upload`,
+		userid, storage, clips, dailyUpload)
+	return err
+}
+
+func GetUsage(ctx context.Context, userid string) (*Usage, error) {
+	var u Usage
+	err := common.Db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COALESCE(SUM(size), 0) FROM blob WHERE user_id = ? AND refs > 0),
+			(SELECT COUNT(*) FROM buffer WHERE user_id = ? AND ttl >= unixepoch()),
+			(SELECT COALESCE(SUM(bytes), 0) FROM upload_volume WHERE user_id = ? AND day = ?)`,
+		userid, userid, userid, today()).Scan(&u.Storage, &u.Clips, &u.DailyUpload)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// trimmedSize is how many bytes of payloads the user stops storing when a
+// new clip, of the payload with the given hash, pushes their oldest clips
+// out of the newest depth. Payloads that clips staying behind or the new
+// one still refer to stay stored.
+func trimmedSize(ctx context.Context, userid string, hash string, depth int) (int64, error) {
+	var size int64
+	err := common.Db.QueryRowContext(ctx, `
+		WITH dropped AS (
+			SELECT hash FROM buffer
+			WHERE user_id = ?1
+			ORDER BY time DESC, rowid DESC
+			LIMIT -1 OFFSET ?2
+		)
+		SELECT COALESCE(SUM(b.size), 0)
+		FROM blob b
+		JOIN (SELECT hash, COUNT(*) AS n FROM dropped GROUP BY hash) d ON d.hash = b.hash
+		WHERE b.user_id = ?1 AND b.refs = d.n AND b.hash != ?3`,
+		userid, max(depth-1, 0), hash).Scan(&size)
+	return size, err
+}
+
+// checkStoredQuota fails if the user can't keep another clip, of the
+// payload with the given hash of which size bytes are new. The newest
+// depth clips are all they keep, so the clips the new one pushes out make
+// room for it.
+func checkStoredQuota(ctx context.Context, userid string, hash string, size int64, depth int) error {
+	q, err := GetQuota(ctx, userid)
+	if err != nil {
+		return err
+	}
+
+	u, err := GetUsage(ctx, userid)
+	if err != nil {
+		return err
+	}
+
+	if q.Storage > 0 && size > 0 {
+		trimmed, err := trimmedSize(ctx, userid, hash, depth)
+		if err != nil {
+			return err
+		}
+		if u.Storage-trimmed+size > q.Storage {
+			return &QuotaError{Quota: "storage", Limit: q.Storage}
+		}
+	}
+	if q.Clips > 0 && min(u.Clips+1, int64(depth)) > q.Clips {
+		return &QuotaError{Quota: "clips", Limit: q.Clips}
+	}
+	return nil
+}
+
+// uploadUsage returns the user's quota and usage for a payload they're
+// about to send, with the storage their next clip frees by pushing the
+// oldest out of their history already taken off.
+func uploadUsage(ctx context.Context, userid string) (*Quota, *Usage, error) {
+	q, err := GetQuota(ctx, userid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u, err := GetUsage(ctx, userid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if q.Storage > 0 {
+		settings, err := GetSettings(ctx, userid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		trimmed, err := trimmedSize(ctx, userid, "", settings.HistoryDepth)
+		if err != nil {
+			return nil, nil, err
+		}
+		u.Storage -= trimmed
+	}
+	return q, u, nil
+}
+
+// CheckUploadQuota fails if the user can't send a payload of size bytes,
+// for rejecting uploads before any of it arrives.
+func CheckUploadQuota(ctx context.Context, userid string, size int64) error {
+	q, u, err := uploadUsage(ctx, userid)
+	if err != nil {
+		return err
+	}
+
+	if q.DailyUpload > 0 && u.DailyUpload+size > q.DailyUpload {
+		return &QuotaError{Quota: "daily_upload", Limit: q.DailyUpload}
+	}
+	if q.Storage > 0 && u.Storage+size > q.Storage {
+		return &QuotaError{Quota: "storage", Limit: q.Storage}
+	}
+	return nil
+}
+
+// UploadAllowance returns how many more bytes the user may send before
+// going over their daily upload or storage quota, or -1 when neither is
+// limited.
+func UploadAllowance(ctx context.Context, userid string) (int64, error) {
+	q, u, err := uploadUsage(ctx, userid)
+	if err != nil {
+		return 0, err
+	}
+
+	allowance := int64(-1)
+	if q.DailyUpload > 0 {
+		allowance = max(q.DailyUpload-u.DailyUpload, 0)
+	}
+	if q.Storage > 0 {
+		left := max(q.Storage-u.Storage, 0)
+		if allowance < 0 || left < allowance {
+			allowance = left
+		}
+	}
+	return allowance, nil
+}
+
+// execer is what *sql.DB and *sql.Tx share for writing.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// recordUpload counts bytes the user sent toward today's upload volume,
+// written with e, unless that would go over their quota q.
+func recordUpload(ctx context.Context, e execer, userid string, bytes int64, q *Quota) error {
+	limit := q.DailyUpload
+	if limit == 0 {
+		limit = -1
+	}
+
+	res, err := e.ExecContext(ctx, `
+		INSERT INTO upload_volume (user_id, day, bytes)
+		SELECT ?1, ?2, ?3
+		WHERE ?4 < 0 OR ?3 + COALESCE((SELECT bytes FROM upload_volume WHERE user_id = ?1 AND day = ?2), 0) <= ?4
+		ON CONFLICT(user_id, day) DO UPDATE SET bytes = bytes + excluded.bytes`,
+		userid, today(), bytes, limit)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &QuotaError{Quota: "daily_upload", Limit: q.DailyUpload}
+	}
+	return nil
+}
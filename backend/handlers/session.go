@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"harmony/backend/common"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A session lasts from signing in on a device until logging out there. It
+// is kept going by refresh tokens, each of which can be used once to get
+// the next one along with a new access token. The tokens of a session form
+// a family: when an already used token comes back, someone else has a copy
+// of it, and the whole session is revoked.
+//
+// Only the SHA-256 of refresh tokens is stored.
+
+type Session struct {
+	Id       string
+	UserId   string
+	DeviceId string
+}
+
+var (
+	ErrNoSession      = errors.New("no session found")
+	ErrSessionRevoked = errors.New("session revoked")
+	ErrTokenReused    = errors.New("refresh token reused")
+)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken adds a new token to the session and returns it.
+func issueRefreshToken(ctx context.Context, tx *sql.Tx, sid string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO refresh_token (hash, session_id, created, expires)
+		VALUES (?, ?, ?, ?)`,
+		hashToken(token), sid, now.Unix(), now.Add(common.RefreshTokenLifetime).Unix())
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// CreateSession starts a session for the user's device and returns it along
+// with its first refresh token.
+func CreateSession(ctx context.Context, userid string, deviceid string) (*Session, string, error) {
+	s := Session{
+		Id:       uuid.New().String(),
+		UserId:   userid,
+		DeviceId: deviceid,
+	}
+
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	now := time.Now().Unix()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO session (_id, user_id, device_id, created, last_used)
+		VALUES (?, ?, ?, ?, ?)`,
+		s.Id, userid, deviceid, now, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := issueRefreshToken(ctx, tx, s.Id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &s, token, nil
+}
+
+// RefreshSession trades a refresh token for the next one. A token that was
+// already traded in revokes its session.
+func RefreshSession(ctx context.Context, token string) (*Session, string, error) {
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Claiming the token is the first statement, so the transaction takes
+	// the write lock before reading anything. Of two refreshes racing with
+	// the same token, the second waits for the first and then finds the
+	// token used, instead of failing to upgrade its read to a write.
+	hash := hashToken(token)
+	res, err := tx.ExecContext(ctx, `
+		UPDATE refresh_token
+		SET used = 1
+		WHERE hash = ? AND used = 0 AND expires >= unixepoch()`,
+		hash)
+	if err != nil {
+		return nil, "", err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var s Session
+	var revoked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT s._id, s.user_id, s.device_id, s.revoked
+		FROM refresh_token t
+		JOIN session s ON s._id = t.session_id
+		WHERE t.hash = ? AND t.expires >= unixepoch()`,
+		hash).Scan(&s.Id, &s.UserId, &s.DeviceId, &revoked)
+	if err == sql.ErrNoRows {
+		err = ErrNoSession
+		return nil, "", err
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	if revoked {
+		err = ErrSessionRevoked
+		return nil, "", err
+	}
+
+	if claimed == 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE session SET revoked = 1 WHERE _id = ?`, s.Id)
+		if err != nil {
+			return nil, "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE session SET last_used = ? WHERE _id = ?`, time.Now().Unix(), s.Id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next, err := issueRefreshToken(ctx, tx, s.Id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &s, next, nil
+}
+
+// CheckSession fails once the session has been revoked.
+func CheckSession(ctx context.Context, sid string) error {
+	var revoked bool
+	err := common.Db.QueryRowContext(ctx, `SELECT revoked FROM session WHERE _id = ?`, sid).Scan(&revoked)
+	if err == sql.ErrNoRows {
+		return ErrNoSession
+	} else if err != nil {
+		return err
+	}
+
+	if revoked {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// RevokeSession ends a session along with every token it has handed out.
+func RevokeSession(ctx context.Context, sid string) error {
+	_, err := common.Db.ExecContext(ctx, `UPDATE session SET revoked = 1 WHERE _id = ?`, sid)
+	return err
+}
+
+// RevokeSessionByToken ends the session a refresh token belongs to, whether
+// or not the token was used already.
+func RevokeSessionByToken(ctx context.Context, token string) error {
+	_, err := common.Db.ExecContext(ctx, `
+		UPDATE session
+		SET revoked = 1
+		WHERE _id = (SELECT session_id FROM refresh_token WHERE hash = ?)`,
+		hashToken(token))
+	return err
+}
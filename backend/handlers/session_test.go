@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"harmony/backend/common"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// openSessionDb sets up a database with the session tables in a file, so
+// that several connections can use it at once as they do in the server.
+func openSessionDb(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "harmony.db")
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	common.Db = db
+
+	_, err = db.Exec(`
+		CREATE TABLE session (
+			_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			last_used INTEGER NOT NULL,
+			revoked INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE TABLE refresh_token (
+			hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			expires INTEGER NOT NULL,
+			used INTEGER NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	openSessionDb(t)
+	ctx := context.Background()
+
+	s, token, err := CreateSession(ctx, "user", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, next, err := RefreshSession(ctx, token)
+	if err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+	if got.Id != s.Id || next == "" || next == token {
+		t.Fatalf("RefreshSession: got session %q and token %q", got.Id, next)
+	}
+
+	if _, _, err := RefreshSession(ctx, "unknown"); err != ErrNoSession {
+		t.Errorf("RefreshSession with an unknown token: got error %v, want ErrNoSession", err)
+	}
+
+	if _, _, err := RefreshSession(ctx, token); err != ErrTokenReused {
+		t.Fatalf("RefreshSession with a used token: got error %v, want ErrTokenReused", err)
+	}
+	if _, _, err := RefreshSession(ctx, next); err != ErrSessionRevoked {
+		t.Errorf("RefreshSession after reuse: got error %v, want ErrSessionRevoked", err)
+	}
+}
+
+func TestRefreshSessionConcurrentReuse(t *testing.T) {
+	openSessionDb(t)
+	ctx := context.Background()
+
+	s, token, err := CreateSession(ctx, "user", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	start := make(chan struct{})
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, _, errs[i] = RefreshSession(ctx, token)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	// one refresh wins, and the others either find the token used or, if
+	// they come after one that did, the session revoked
+	var ok, reused int
+	for _, err := range errs {
+		switch err {
+		case nil:
+			ok++
+		case ErrTokenReused:
+			reused++
+		case ErrSessionRevoked:
+		default:
+			t.Errorf("RefreshSession: unexpected error %v", err)
+		}
+	}
+	if ok != 1 || reused == 0 {
+		t.Errorf("got %d refreshes and %d reuses, want 1 and at least 1", ok, reused)
+	}
+
+	if err := CheckSession(ctx, s.Id); err != ErrSessionRevoked {
+		t.Errorf("CheckSession after reuse: got error %v, want ErrSessionRevoked", err)
+	}
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"harmony/backend/common"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Personal access tokens let scripts use the API on a user's behalf, within
+// the scopes they were given. Like refresh tokens, only their SHA-256 is
+// stored, so a token is only ever shown when it's created.
+
+// TokenPrefix starts every personal access token, which makes them easy to
+// tell apart and to spot in leaked logs.
+const TokenPrefix = "hmy_"
+
+const (
+	ScopeRead   = "read"   // get clips and follow new ones
+	ScopePush   = "push"   // add clips
+	ScopeDelete = "delete" // delete clips
+)
+
+var TokenScopes = []string{ScopeRead, ScopePush, ScopeDelete}
+
+type Token struct {
+	Id       string   `json:"id"`
+	UserId   string   `json:"-"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Created  int64    `json:"created"`
+	Expires  *int64   `json:"expires"`
+	LastUsed *int64   `json:"last_used"`
+	Revoked  bool     `json:"revoked"`
+}
+
+var (
+	ErrNoToken      = errors.New("no token found")
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// CreateToken stores a new token for the user and returns its secret.
+// Tokens without an expiry last until they're revoked.
+func CreateToken(ctx context.Context, t *Token) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := TokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	t.Id = uuid.New().String()
+	t.Created = time.Now().Unix()
+
+	_, err := common.Db.ExecContext(ctx, `
+		INSERT INTO personal_token (_id, user_id, name, hash, scopes, created, expires)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.Id, t.UserId, t.Name, hashToken(secret), strings.Join(t.Scopes, " "), t.Created, t.Expires)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func scanToken(scan func(dest ...any) error) (*Token, error) {
+	var t Token
+	var scopes string
+	var expires, lastUsed sql.NullInt64
+
+	err := scan(&t.Id, &t.UserId, &t.Name, &scopes, &t.Created, &expires, &lastUsed, &t.Revoked)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Scopes = strings.Fields(scopes)
+	if expires.Valid {
+		t.Expires = &expires.Int64
+	}
+	if lastUsed.Valid {
+		t.LastUsed = &lastUsed.Int64
+	}
+	return &t, nil
+}
+
+func checkToken(t *Token) error {
+	if t.Revoked {
+		return ErrTokenRevoked
+	}
+	if t.Expires != nil && *t.Expires < time.Now().Unix() {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// CheckToken finds the token with the given secret, failing unless it's
+// still valid, and records that it was used.
+func CheckToken(ctx context.Context, secret string) (*Token, error) {
+	row := common.Db.QueryRowContext(ctx, `
+		SELECT _id, user_id, name, scopes, created, expires, last_used, revoked
+		FROM personal_token
+		WHERE hash = ?`,
+		hashToken(secret))
+
+	t, err := scanToken(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := checkToken(t); err != nil {
+		return nil, err
+	}
+
+	// like a device's last_seen, last_used is only informational
+	now := time.Now()
+	if t.LastUsed == nil || now.Sub(time.Unix(*t.LastUsed, 0)) >= lastSeenResolution {
+		_, err = common.Db.ExecContext(ctx, `
+			UPDATE personal_token SET last_used = ?
+			WHERE _id = ? AND last_used IS ?`,
+			now.Unix(), t.Id, t.LastUsed)
+		if err != nil {
+			slog.WarnContext(ctx, "recording when the token was last used", "token_id", t.Id, "error", err)
+		}
+	}
+
+	return t, nil
+}
+
+// CheckTokenById fails once the token has expired or been revoked.
+func CheckTokenById(ctx context.Context, id string) error {
+	row := common.Db.QueryRowContext(ctx, `
+		SELECT _id, user_id, name, scopes, created, expires, last_used, revoked
+		FROM personal_token
+		WHERE _id = ?`,
+		id)
+
+	t, err := scanToken(row.Scan)
+	if err == sql.ErrNoRows {
+		return ErrNoToken
+	} else if err != nil {
+		return err
+	}
+
+	return checkToken(t)
+}
+
+func ListTokens(ctx context.Context, userid string) ([]Token, error) {
+	rows, err := common.Db.QueryContext(ctx, `
+		SELECT _id, user_id, name, scopes, created, expires, last_used, revoked
+		FROM personal_token
+		WHERE user_id = ?
+		ORDER BY created DESC, rowid DESC`,
+		userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		t, err := scanToken(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func RevokeToken(ctx context.Context, userid string, id string) error {
+	res, err := common.Db.ExecContext(ctx, `
+		UPDATE personal_token
+		SET revoked = 1
+		WHERE _id = ? AND user_id = ?`,
+		id, userid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoToken
+	}
+
+	return nil
+}
@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"harmony/backend/common"
+	"harmony/backend/storage"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload is a clip being sent in chunks. Chunk i covers the bytes from
+// i*ChunkSize up to the next chunk, the last one possibly being shorter.
+type Upload struct {
+	Id         string  `json:"id"`
+	UserId     string  `json:"-"`
+	Type       BufType `json:"type"`
+	Encryption string  `json:"encryption,omitempty"`
+	Lifetime   int64   `json:"lifetime,omitempty"`
+	Size       int64   `json:"size"`
+	ChunkSize  int64   `json:"chunk_size"`
+	Created    int64   `json:"created"`
+	Updated    int64   `json:"updated"`
+	Chunks     []Chunk `json:"chunks"`
+}
+
+type Chunk struct {
+	Index    int64  `json:"index"`
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+var (
+	ErrNoUpload         = errors.New("no upload found")
+	ErrIncompleteUpload = errors.New("upload is missing chunks")
+	ErrUploadFinalizing = errors.New("upload is being finalized")
+)
+
+// ChunkCount is the number of chunks the upload is split into.
+func (u *Upload) ChunkCount() int64 {
+	return (u.Size + u.ChunkSize - 1) / u.ChunkSize
+}
+
+// ChunkLength is the exact size chunk i must have.
+func (u *Upload) ChunkLength(i int64) int64 {
+	return min(u.ChunkSize, u.Size-i*u.ChunkSize)
+}
+
+func CreateUpload(ctx context.Context, u *Upload) error {
+	now := time.Now().Unix()
+	u.Id = uuid.New().String()
+	u.Created = now
+	u.Updated = now
+	u.Chunks = []Chunk{}
+
+	_, err := common.Db.ExecContext(ctx, `
+		INSERT INTO upload (_id, user_id, type, encryption, lifetime, size, chunk_size, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.Id, u.UserId, string(u.Type), u.Encryption, u.Lifetime, u.Size, u.ChunkSize, u.Created, u.Updated)
+	return err
+}
+
+// GetUpload returns the upload along with the chunks received so far.
+func GetUpload(ctx context.Context, userid string, id string) (*Upload, error) {
+	u := Upload{UserId: userid}
+	var bufType string
+
+	err := common.Db.QueryRowContext(ctx, `
+		SELECT _id, type, encryption, lifetime, size, chunk_size, created, updated
+		FROM upload
+		WHERE _id = ? AND user_id = ?`,
+		id, userid).Scan(&u.Id, &bufType, &u.Encryption, &u.Lifetime, &u.Size, &u.ChunkSize, &u.Created, &u.Updated)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoUpload
+	} else if err != nil {
+		return nil, err
+	}
+	u.Type = BufType(bufType)
+
+	rows, err := common.Db.QueryContext(ctx, `
+		SELECT idx, start, size, checksum
+		FROM upload_chunk
+		WHERE upload_id = ?
+		ORDER BY idx`,
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	u.Chunks = []Chunk{}
+	for rows.Next() {
+		var ch Chunk
+		if err := rows.Scan(&ch.Index, &ch.Offset, &ch.Size, &ch.Checksum); err != nil {
+			return nil, err
+		}
+		u.Chunks = append(u.Chunks, ch)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// PutChunk stores a chunk, replacing any earlier copy of it, and counts it
+// toward the user's upload volume. The caller checks the chunk against the
+// upload's layout and its checksum. Only the first copy of each chunk is
+// counted, so clients can retry chunks without being charged twice.
+func PutChunk(ctx context.Context, u *Upload, ch Chunk, data []byte) error {
+	q, err := GetQuota(ctx, u.UserId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// writing first takes the database's write lock, so copies of a chunk
+	// racing each other can't both be counted as the first
+	res, err := tx.ExecContext(ctx, `UPDATE upload SET updated = ? WHERE _id = ? AND state = 'open'`, time.Now().Unix(), u.Id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err = ErrUploadFinalizing
+		return err
+	}
+
+	res, err = tx.ExecContext(ctx, `
+		INSERT INTO upload_chunk (upload_id, idx, start, size, checksum)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (upload_id, idx) DO NOTHING`,
+		u.Id, ch.Index, ch.Offset, ch.Size, ch.Checksum)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 1 {
+		err = recordUpload(ctx, tx, u.UserId, ch.Size, q)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE upload_chunk SET checksum = ?
+			WHERE upload_id = ? AND idx = ?`,
+			ch.Checksum, u.Id, ch.Index)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = storage.PutTx(ctx, tx, storage.ChunkKey(u.Id, ch.Index), data)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// chunkReader reads an upload's payload from storage, a chunk at a time.
+type chunkReader struct {
+	ctx   context.Context
+	u     *Upload
+	next  int64
+	chunk []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.next == r.u.ChunkCount() {
+			return 0, io.EOF
+		}
+
+		data, err := storage.Get(r.ctx, storage.ChunkKey(r.u.Id, r.next))
+		if err == storage.ErrNotFound {
+			return 0, ErrIncompleteUpload
+		} else if err != nil {
+			return 0, err
+		}
+		if int64(len(data)) != r.u.ChunkLength(r.next) {
+			return 0, ErrIncompleteUpload
+		}
+
+		r.chunk = data
+		r.next++
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// FinalizeUpload turns the upload into a clip once all of its chunks are
+// in, failing with ErrIncompleteUpload before then, and deletes the upload.
+// Only one call gets to finalize an upload; the others fail with
+// ErrUploadFinalizing. The payload goes from the chunks to storage a chunk
+// at a time, and the clip comes back without its Data.
+func FinalizeUpload(ctx context.Context, u *Upload) (*Buffer, error) {
+	if int64(len(u.Chunks)) != u.ChunkCount() {
+		return nil, ErrIncompleteUpload
+	}
+
+	// like insertBuffer, finish once started
+	ctx = context.WithoutCancel(ctx)
+
+	res, err := common.Db.ExecContext(ctx, `
+		UPDATE upload SET state = 'finalizing', updated = ?
+		WHERE _id = ? AND state = 'open'`,
+		time.Now().Unix(), u.Id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrUploadFinalizing
+	}
+
+	b, err := finalizeUpload(ctx, u)
+	if err != nil {
+		// let the client try again, after making room for the clip say
+		_, uerr := common.Db.ExecContext(ctx, `UPDATE upload SET state = 'open' WHERE _id = ?`, u.Id)
+		if uerr != nil {
+			slog.ErrorContext(ctx, "reopening upload", "upload_id", u.Id, "error", uerr)
+		}
+		return nil, err
+	}
+
+	if err := DeleteUpload(ctx, u.UserId, u.Id); err != nil {
+		slog.ErrorContext(ctx, "deleting finalized upload", "upload_id", u.Id, "error", err)
+	}
+	return b, nil
+}
+
+func finalizeUpload(ctx context.Context, u *Upload) (*Buffer, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, &chunkReader{ctx: ctx, u: u}); err != nil {
+		return nil, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	settings, err := GetSettings(ctx, u.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBuffer(u.UserId, hash, u.Type, u.Encryption, time.Duration(u.Lifetime)*time.Second, settings)
+	b.Size = u.Size
+
+	blobMu.RLock()
+	defer blobMu.RUnlock()
+
+	_, err = GetBlobSize(ctx, u.UserId, hash)
+	if err == ErrNoBlob {
+		err = checkStoredQuota(ctx, u.UserId, hash, u.Size, settings.HistoryDepth)
+		if err == nil {
+			err = storage.PutStream(ctx, storage.BlobKey(u.UserId, hash), &chunkReader{ctx: ctx, u: u}, u.Size)
+		}
+	} else if err == nil {
+		err = checkStoredQuota(ctx, u.UserId, hash, 0, settings.HistoryDepth)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the chunks were counted as they came in
+	if err := addBuffer(ctx, &b, settings.HistoryDepth, 0); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func DeleteUpload(ctx context.Context, userid string, id string) error {
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM upload_chunk
+		WHERE upload_id IN (SELECT _id FROM upload WHERE _id = ? AND user_id = ?)`,
+		id, userid)
+	if err != nil {
+		return err
+	}
+
+	u := Upload{Id: id}
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM upload
+		WHERE _id = ? AND user_id = ?
+		RETURNING size, chunk_size`,
+		id, userid).Scan(&u.Size, &u.ChunkSize)
+	if err == sql.ErrNoRows {
+		err = ErrNoUpload
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	deleteChunks(ctx, &u)
+	return nil
+}
+
+// CollectUploads deletes the uploads nobody has touched since before, and
+// returns how many it deleted.
+func CollectUploads(ctx context.Context, before time.Time) (int, error) {
+	tx, err := common.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM upload_chunk
+		WHERE upload_id IN (SELECT _id FROM upload WHERE updated < ?)`,
+		before.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM upload
+		WHERE updated < ?
+		RETURNING _id, size, chunk_size`,
+		before.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	var uploads []Upload
+	for rows.Next() {
+		var u Upload
+		if err = rows.Scan(&u.Id, &u.Size, &u.ChunkSize); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		uploads = append(uploads, u)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range uploads {
+		deleteChunks(ctx, &uploads[i])
+		if ctx.Err() != nil {
+			return len(uploads), ctx.Err()
+		}
+	}
+	return len(uploads), nil
+}
+
+// deleteChunks deletes the payloads of the upload's chunks, whether they
+// arrived or not. Like a blob's, a chunk payload left behind by a failed
+// delete is only wasted space.
+func deleteChunks(ctx context.Context, u *Upload) {
+	for i := range u.ChunkCount() {
+		err := storage.Delete(ctx, storage.ChunkKey(u.Id, i))
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "deleting upload chunk", "upload_id", u.Id, "index", i, "error", err)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package hub
+
+import (
+	"cmp"
+	"encoding/json"
+	"harmony/backend/common"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ClipAdded   = "clip"
+	ClipDeleted = "delete"
+	Cleared     = "clear"
+	Reset       = "reset"
+)
+
+// Event describes a change to a user's buffer. Version is that of the
+// buffer after the change, which is also the event's id. Data is only set
+// for ClipAdded on the instance the clip was stored on and is never
+// serialized; listeners that need the payload and don't have it read it
+// from storage.
+type Event struct {
+	Action     string `json:"-"`
+	Id         string `json:"id,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Encryption string `json:"encryption,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Time       int64  `json:"time,omitempty"`
+	Ttl        int64  `json:"ttl,omitempty"`
+	Version    int64  `json:"version,omitempty"`
+	Data       []byte `json:"-"`
+}
+
+const (
+	queueSize   = 8
+	historySize = 64
+
+	// how long a user's history is kept after their last listener left,
+	// for listeners that reconnect
+	idleTimeout = 5 * time.Minute
+)
+
+type user struct {
+	history []Event
+	subs    map[chan Event]struct{}
+	// when the last listener left, if none are left
+	idleSince time.Time
+}
+
+var (
+	mu        sync.Mutex
+	users     = make(map[string]*user)
+	lastSweep time.Time
+
+	rdb *redis.Client
+	sub *redis.PubSub
+	// tells this instance's events apart from the others' on Redis
+	origin = uuid.New().String()
+)
+
+// message is an event as it's passed between instances.
+type message struct {
+	Origin string `json:"origin"`
+	Action string `json:"action"`
+	Event
+}
+
+// channel is where events of the user are passed between instances.
+func channel(uid string) string {
+	return "hub:" + uid
+}
+
+// Setup passes events through Redis, so listeners on every backend
+// instance hear about them, when the cache uses it. It has to run after
+// cache.Setup, which connects to Redis. Without Redis, events only reach
+// listeners on this instance.
+func Setup() {
+	if common.Rdb == nil {
+		return
+	}
+
+	rdb = common.Rdb
+	sub = rdb.PSubscribe(common.Ctx, channel("*"))
+	go listen()
+}
+
+// Close stops listening to the other instances.
+func Close() error {
+	if sub == nil {
+		return nil
+	}
+	return sub.Close()
+}
+
+// listen hands the events of other instances to listeners here until the
+// subscription is closed. The subscription reconnects by itself after
+// Redis goes away; listeners who missed events in the meantime are told
+// to reset when they reconnect.
+func listen() {
+	for msg := range sub.Channel() {
+		uid, ok := strings.CutPrefix(msg.Channel, channel(""))
+		if !ok {
+			continue
+		}
+
+		var m message
+		if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+			slog.Warn("decoding event from another instance", "error", err)
+			continue
+		}
+		if m.Origin == origin {
+			continue
+		}
+
+		m.Event.Action = m.Action
+		deliver(uid, m.Event)
+	}
+}
+
+// EventId formats the id sent to clients for an event.
+func EventId(version int64) string {
+	return strconv.FormatInt(version, 10)
+}
+
+func parseEventId(id string) (int64, bool) {
+	version, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+func getUser(uid string) *user {
+	u := users[uid]
+	if u == nil {
+		u = &user{subs: make(map[chan Event]struct{}), idleSince: time.Now()}
+		users[uid] = u
+	}
+	return u
+}
+
+// sweep forgets the users nobody has listened to in idleTimeout. It only
+// looks once a minute, so it's cheap to call on every change.
+func sweep() {
+	now := time.Now()
+	if now.Sub(lastSweep) < time.Minute {
+		return
+	}
+	lastSweep = now
+
+	for uid, u := range users {
+		if len(u.subs) == 0 && now.Sub(u.idleSince) > idleTimeout {
+			delete(users, uid)
+		}
+	}
+}
+
+// Subscribe registers a listener for the user's events. The returned function
+// must be called to unregister it once the listener is gone.
+func Subscribe(uid string) (<-chan Event, func()) {
+	ch, _, cancel := SubscribeSince(uid, "", 0)
+	return ch, cancel
+}
+
+// SubscribeSince works like Subscribe, and also returns the events after
+// lastId, which a listener that was here before got last. current is the
+// version of the user's buffer. The backlog is empty when the listener
+// already has current, and a single Reset event telling it to resync from
+// scratch when the events it missed aren't all remembered here.
+func SubscribeSince(uid string, lastId string, current int64) (<-chan Event, []Event, func()) {
+	ch := make(chan Event, queueSize)
+
+	mu.Lock()
+	sweep()
+	u := getUser(uid)
+	u.subs[ch] = struct{}{}
+
+	var backlog []Event
+	if lastId != "" {
+		last, ok := parseEventId(lastId)
+		if ok {
+			for _, e := range u.history {
+				if e.Version > last {
+					backlog = append(backlog, e)
+				}
+			}
+			ok = complete(backlog, last, current)
+		}
+		if !ok {
+			backlog = []Event{{Action: Reset, Version: max(current, latest(u))}}
+		}
+	}
+	mu.Unlock()
+
+	return ch, backlog, func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		u := users[uid]
+		if u == nil {
+			return
+		}
+		if _, ok := u.subs[ch]; !ok {
+			return
+		}
+		delete(u.subs, ch)
+		close(ch)
+
+		if len(u.subs) == 0 {
+			u.idleSince = time.Now()
+		}
+	}
+}
+
+// complete reports whether the backlog holds every event after version
+// last up to current. Each change moves the version on by one, so that's
+// when they follow each other without gaps.
+func complete(backlog []Event, last int64, current int64) bool {
+	for _, e := range backlog {
+		if e.Version != last+1 {
+			return false
+		}
+		last = e.Version
+	}
+	return last >= current
+}
+
+// latest is the version of the newest event remembered for the user.
+func latest(u *user) int64 {
+	if len(u.history) == 0 {
+		return 0
+	}
+	return u.history[len(u.history)-1].Version
+}
+
+// Publish hands the event to every listener of the user, on this instance
+// and through Redis on the others.
+func Publish(uid string, e Event) {
+	deliver(uid, e)
+
+	if rdb == nil {
+		return
+	}
+
+	payload, err := json.Marshal(message{Origin: origin, Action: e.Action, Event: e})
+	if err != nil {
+		slog.Error("encoding event", "error", err)
+		return
+	}
+
+	// listeners elsewhere that miss the event are told to reset once they
+	// reconnect, or catch up through GET /buffer
+	if err := rdb.Publish(common.Ctx, channel(uid), payload).Err(); err != nil {
+		slog.Warn("passing event to other instances", "error", err, "user_id", uid)
+	}
+}
+
+// deliver records the event and hands it to every listener of the user here
+// without blocking. Listeners that fall behind miss the event and have to
+// catch up through GET /buffer.
+func deliver(uid string, e Event) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	sweep()
+	u := getUser(uid)
+
+	// the history is only used to replay metadata, so don't hold on to
+	// payloads; events from other instances can arrive out of order
+	h := e
+	h.Data = nil
+	i, _ := slices.BinarySearchFunc(u.history, h.Version, func(e Event, v int64) int {
+		return cmp.Compare(e.Version, v)
+	})
+	u.history = slices.Insert(u.history, i, h)
+	if len(u.history) > historySize {
+		u.history = u.history[len(u.history)-historySize:]
+	}
+
+	for ch := range u.subs {
+		select {
+		case ch <- e:
+		default:
+			slog.Warn("dropping event for a slow listener", "version", e.Version, "user_id", uid)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package identity finds out who a client is from the OAuth access token it
+// got from the identity provider, instead of taking its word for it.
+//
+// Any app can get a token for the same account, so the token is first
+// checked to have been issued to harmony's app, at the identity_token_url
+// setting. That defaults to GitHub's token check for the app in
+// identity_client_id, which authenticates with identity_client_secret and
+// answers with the app the token belongs to:
+//
+//	{"app": {"client_id": "Iv23..."}, ...}
+//
+// Then the provider is asked for the account's emails, at the
+// identity_emails_url setting. That defaults to GitHub's, and anything
+// answering in the same shape will do:
+//
+//	[{"email": "a@b.c", "primary": true, "verified": true}, ...]
+package identity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultEmailsURL = "https://api.github.com/user/emails"
+
+	// DefaultClientID is the app the client signs in through.
+	DefaultClientID = "Iv23lixNQQwpjTJDJGf5"
+)
+
+// DefaultTokenURL is GitHub's token check for the app.
+func DefaultTokenURL(clientID string) string {
+	return "https://api.github.com/applications/" + clientID + "/token"
+}
+
+// App is the OAuth app tokens have to be issued to.
+type App struct {
+	ClientID     string
+	ClientSecret string
+	// TokenURL checks which app a token was issued to.
+	TokenURL string
+}
+
+var (
+	emailsURL = DefaultEmailsURL
+	app       App
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid access token")
+	ErrNoVerifiedEmail = errors.New("no verified primary email")
+)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+type email struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// Setup sets where the provider lists an account's emails, and the app
+// tokens have to be issued to.
+func Setup(url string, a App) {
+	emailsURL = url
+	app = a
+}
+
+// checkApp asks the provider whether the token was issued to the app.
+// Tokens of other apps are as invalid as any, however valid they are to
+// the provider.
+func checkApp(ctx context.Context, token string) error {
+	body, err := json.Marshal(map[string]string{"access_token": token})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", app.TokenURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(app.ClientID, app.ClientSecret)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("checking the token with the identity provider: %w", err)
+	}
+	defer res.Body.Close()
+
+	// GitHub answers 404 for tokens that aren't the app's, and 422 for
+	// ones that aren't tokens at all
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusUnprocessableEntity:
+		return ErrInvalidToken
+	default:
+		return fmt.Errorf("identity provider responded to the token check with %s", res.Status)
+	}
+
+	var check struct {
+		App struct {
+			ClientID string `json:"client_id"`
+		} `json:"app"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&check); err != nil {
+		return fmt.Errorf("reading the identity provider's token check: %w", err)
+	}
+	if check.App.ClientID != app.ClientID {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// VerifyToken checks the token was issued to harmony's app, asks the
+// provider whose token it is, and returns the account's primary email if
+// the provider has verified it.
+func VerifyToken(ctx context.Context, token string) (string, error) {
+	if err := checkApp(ctx, token); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", emailsURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("asking the identity provider: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", ErrInvalidToken
+	default:
+		return "", fmt.Errorf("identity provider responded with %s", res.Status)
+	}
+
+	var emails []email
+	if err := json.NewDecoder(res.Body).Decode(&emails); err != nil {
+		return "", fmt.Errorf("reading the identity provider's response: %w", err)
+	}
+
+	for _, e := range emails {
+		if e.Primary && e.Verified && e.Email != "" {
+			return e.Email, nil
+		}
+	}
+	return "", ErrNoVerifiedEmail
+}
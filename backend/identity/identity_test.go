@@ -0,0 +1,88 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeProvider answers like GitHub for two tokens of the same account: one
+// issued to harmony's app, and one issued to some other app.
+func fakeProvider(t *testing.T) *httptest.Server {
+	apps := map[string]string{
+		"harmony-token": "harmony-app",
+		"foreign-token": "foreign-app",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /applications/harmony-app/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "harmony-app" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		// GitHub only knows the tokens of the app asking
+		if apps[body.AccessToken] != "harmony-app" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"app": map[string]string{"client_id": "harmony-app"}})
+	})
+	mux.HandleFunc("GET /user/emails", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := apps[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]; !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode([]email{{Email: "a@b.c", Primary: true, Verified: true}})
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVerifyToken(t *testing.T) {
+	srv := fakeProvider(t)
+	Setup(srv.URL+"/user/emails", App{
+		ClientID:     "harmony-app",
+		ClientSecret: "secret",
+		TokenURL:     srv.URL + "/applications/harmony-app/token",
+	})
+	ctx := context.Background()
+
+	if e, err := VerifyToken(ctx, "harmony-token"); err != nil || e != "a@b.c" {
+		t.Errorf("VerifyToken of harmony's token: got %q, %v", e, err)
+	}
+
+	// the provider vouches for the account, but the token wasn't meant for
+	// harmony
+	if e, err := VerifyToken(ctx, "foreign-token"); err != ErrInvalidToken {
+		t.Errorf("VerifyToken of another app's token: got %q, %v, want ErrInvalidToken", e, err)
+	}
+
+	if e, err := VerifyToken(ctx, "unknown-token"); err != ErrInvalidToken {
+		t.Errorf("VerifyToken of an unknown token: got %q, %v, want ErrInvalidToken", e, err)
+	}
+
+	// a token check answering for another app doesn't count either
+	Setup(srv.URL+"/user/emails", App{
+		ClientID:     "other-app",
+		ClientSecret: "secret",
+		TokenURL:     srv.URL + "/applications/harmony-app/token",
+	})
+	if e, err := VerifyToken(ctx, "harmony-token"); err == nil {
+		t.Errorf("VerifyToken checked against the wrong app: got %q, want an error", e)
+	}
+}
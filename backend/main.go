@@ -2,37 +2,136 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"harmony/backend/api"
 	"harmony/backend/cache"
 	"harmony/backend/common"
+	"harmony/backend/config"
 	"harmony/backend/db"
-	"log"
+	"harmony/backend/handlers"
+	"harmony/backend/hub"
+	"harmony/backend/identity"
+	"harmony/backend/logging"
+	"harmony/backend/ratelimit"
+	"harmony/backend/storage"
+	"harmony/backend/utils"
+	"io/fs"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/joho/godotenv"
 )
 
-func checkEnv() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatalf("[error] loading .env file: %v", err)
+const usage = `Usage:
+  harmony [flags]         serve the API
+  harmony config [flags]  print the configuration the flags, env and config
+                          file add up to, with secrets redacted, and exit
+
+Settings are read from the config file, then env vars, then flags, each
+overriding the last.
+
+Flags:
+`
+
+// loadConfig reads the settings from a .env file if there is one, along
+// with the rest of the environment, the config file and args. Everything
+// wrong with them is reported before exiting.
+func loadConfig(fset *flag.FlagSet, args []string) *config.Config {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "harmony: loading .env file: %v\n", err)
+		os.Exit(1)
 	}
 
-	for _, v := range []string{"PORT", "JWT_SK", "REDIS_HOST", "REDIS_PWD"} {
-		if os.Getenv(v) == "" {
-			log.Fatalf("[error] %s env var not set", v)
+	cfg, err := config.Load(fset, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "harmony: invalid configuration:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "  "+line)
 		}
+		os.Exit(2)
 	}
+	return cfg
 }
 
 func main() {
+	args := os.Args[1:]
+	printConfig := len(args) > 0 && args[0] == "config"
+	if printConfig {
+		args = args[1:]
+	}
+
+	fset := flag.NewFlagSet("harmony", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprint(fset.Output(), usage)
+		fset.PrintDefaults()
+	}
+	dryRun := fset.Bool("migrate-dry-run", false, "check that the pending database migrations apply, without applying them, and exit")
+	cfg := loadConfig(fset, args)
+
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "harmony: printing configuration: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logging.Setup(cfg.SlogLevel())
 	common.Ctx = context.Background()
-	checkEnv()
+	common.Lifetime = cfg.Lifetime
+	common.DataDir = cfg.DataDir
+	utils.SetSigningKey(cfg.JWTKey())
+	identity.Setup(cfg.IdentityEmailsURL, identity.App{
+		ClientID:     cfg.IdentityClientID,
+		ClientSecret: cfg.IdentityClientSecret,
+		TokenURL:     cfg.IdentityTokenURL,
+	})
 
-	cache.Setup()
-	err := db.Setup()
+	if *dryRun {
+		if err := db.Open(); err != nil {
+			logging.Fatal("opening database", "error", err)
+		}
+		if err := storage.Setup(cfg.Storage); err != nil {
+			logging.Fatal("setting up storage", "error", err)
+		}
+		if err := db.Migrate(common.Ctx, true); err != nil {
+			logging.Fatal("checking migrations", "error", err)
+		}
+		return
+	}
+
+	cache.Setup(cfg.Cache, cfg.Redis)
+	hub.Setup()
+	ratelimit.Setup()
+	handlers.SetupQuotas(cfg.Quota)
+
+	// SIGINT and SIGTERM shut the backend down gracefully. Once that's
+	// begun, another one kills it outright.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+
+	err := db.Setup(ctx, cfg.Storage)
 	if err != nil {
-		log.Fatalf("[error] setting up database: %v", err)
+		logging.Fatal("setting up database", "error", err)
+	}
+
+	if err := api.Setup(ctx, cfg); err != nil {
+		logging.Fatal("serving", "error", err)
+	}
+
+	if err := db.Close(); err != nil {
+		slog.Error("closing database", "error", err)
+	}
+	if err := hub.Close(); err != nil {
+		slog.Error("closing event subscription", "error", err)
+	}
+	if err := cache.Close(); err != nil {
+		slog.Error("closing redis", "error", err)
 	}
-	api.Setup()
+	slog.Info("shut down")
 }
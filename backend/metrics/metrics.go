@@ -0,0 +1,79 @@
+// Package metrics collects what the backend is up to in Prometheus format:
+// HTTP requests, clip sizes, how often clients are answered from the
+// version cache, database and Redis calls, and the cleanup job.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "harmony_http_requests_total",
+		Help: "HTTP requests handled, by route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "harmony_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, including long-polls.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"method", "route"})
+
+	ClipSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "harmony_clip_size_bytes",
+		Help:    "Size of the payloads of stored clips.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 12),
+	})
+
+	// VersionChecks counts GET /buffer requests that asked for something
+	// newer than a version, by whether the cache said there was nothing
+	// newer, which is answered with a 304 without going to the database.
+	VersionChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "harmony_buffer_version_checks_total",
+		Help: "Requests for a newer clip, by whether they were answered from the cache with 304.",
+	}, []string{"result"})
+
+	CacheDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "harmony_cache_degraded",
+		Help: "1 while Redis can't be reached and this instance runs on its local cache.",
+	})
+
+	CleanupDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "harmony_cleanup_deleted_total",
+		Help: "Rows deleted by the cleanup job, by what they were.",
+	}, []string{"kind"})
+
+	CleanupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "harmony_cleanup_duration_seconds",
+		Help:    "Time taken by cleanup job runs.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	CleanupLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "harmony_cleanup_last_run_timestamp_seconds",
+		Help: "When the cleanup job last finished a run.",
+	})
+)
+
+// Middleware records every request. It has to come before the other
+// middleware, so requests they turn away are counted too.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// unmatched paths are left out, they'd make a label per path
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "harmony_db_query_duration_seconds",
+		Help:    "Time taken by database statements, by whether they were queries or execs.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"op"})
+
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "harmony_db_errors_total",
+		Help: "Database statements that failed.",
+	}, []string{"op"})
+)
+
+func observeDb(op string, start time.Time, err error) {
+	dbDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// WrapDriver times the statements run through connections of a database
+// driver. Statements run through prepared statements aren't timed; the
+// backend doesn't prepare any.
+func WrapDriver(d driver.Driver) driver.Driver {
+	return &sqlDriver{d}
+}
+
+type sqlDriver struct {
+	driver.Driver
+}
+
+func (d *sqlDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{c}, nil
+}
+
+// sqlConn passes everything on to the driver's connection, falling back to
+// what database/sql does for drivers without the optional interfaces.
+type sqlConn struct {
+	driver.Conn
+}
+
+func (c *sqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *sqlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	observeDb("exec", start, err)
+	return res, err
+}
+
+func (c *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	observeDb("query", start, err)
+	return rows, err
+}
+
+func (c *sqlConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
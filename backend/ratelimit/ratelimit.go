@@ -0,0 +1,39 @@
+// Package ratelimit keeps clients from flooding the API, with a token bucket
+// per user and per IP address for each kind of request.
+//
+// Buckets are kept in Redis when the cache uses it, so limits hold across
+// backend instances, and in this process otherwise.
+package ratelimit
+
+import (
+	"context"
+	"harmony/backend/common"
+	"time"
+)
+
+// Limit allows bursts of Burst requests, refilled at Rate per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+type Limiter interface {
+	// Allow takes a token from the bucket at key. When it's empty, it
+	// returns how long until the next token is available instead.
+	Allow(ctx context.Context, key string, l Limit) (bool, time.Duration)
+}
+
+var limiter Limiter
+
+func Allow(ctx context.Context, key string, l Limit) (bool, time.Duration) {
+	return limiter.Allow(ctx, key, l)
+}
+
+// Setup has to run after cache.Setup, which connects to Redis.
+func Setup() {
+	if common.Rdb != nil {
+		limiter = NewRedisLimiter(common.Rdb)
+	} else {
+		limiter = NewMemoryLimiter()
+	}
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// allowScript refills and takes from a bucket in one step, so concurrent
+// requests on different instances can't both take the last token. It
+// returns how many milliseconds to wait, or 0 when a token was taken.
+// Buckets expire once they would be full again anyway.
+var allowScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local b = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(b[1]) or burst
+local updated = tonumber(b[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate / 1000)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) * 1000 / rate) + 1000)
+return wait
+`)
+
+// RedisLimiter keeps buckets in Redis, shared by every backend instance.
+// While Redis can't be reached, each instance limits on its own with a
+// MemoryLimiter instead of letting everything through.
+type RedisLimiter struct {
+	rdb   *redis.Client
+	local *MemoryLimiter
+	down  atomic.Bool
+}
+
+func NewRedisLimiter(rdb *redis.Client) *RedisLimiter {
+	return &RedisLimiter{rdb: rdb, local: NewMemoryLimiter()}
+}
+
+func (r *RedisLimiter) Allow(ctx context.Context, key string, l Limit) (bool, time.Duration) {
+	now := time.Now().UnixMilli()
+	wait, err := allowScript.Run(ctx, r.rdb, []string{"ratelimit:" + key},
+		strconv.FormatFloat(l.Rate, 'f', -1, 64), l.Burst, now).Int64()
+	if err != nil {
+		// a request that's gone away says nothing about Redis
+		if ctx.Err() == nil && !r.down.Swap(true) {
+			slog.WarnContext(ctx, "redis unavailable, rate limiting locally", "error", err)
+		}
+		return r.local.Allow(ctx, key, l)
+	}
+
+	if r.down.Swap(false) {
+		slog.InfoContext(ctx, "redis is back, rate limiting across instances again")
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond
+}
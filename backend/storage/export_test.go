@@ -0,0 +1,7 @@
+package storage
+
+// CurrentStore returns the backend payloads are kept in, for tests that
+// replace it to put it back.
+func CurrentStore() Store {
+	return store
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"harmony/backend/common"
+)
+
+// SQLiteStore keeps payloads in the payload table of the harmony database,
+// which the database migrations create.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore() *SQLiteStore {
+	return &SQLiteStore{db: common.Db}
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *SQLiteStore) Put(ctx context.Context, key string, data []byte) error {
+	return put(ctx, s.db, key, data)
+}
+
+func put(ctx context.Context, e execer, key string, data []byte) error {
+	_, err := e.ExecContext(ctx, `
+		INSERT INTO payload (key, data)
+		VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET data = excluded.data`,
+		key, data)
+	return err
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM payload WHERE key = ?`, key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM payload WHERE key = ?`, key)
+	return err
+}
@@ -0,0 +1,145 @@
+// Package storage keeps clip payloads, separately from the clip metadata in
+// the database. Payloads are addressed by key and never change once
+// written, so backends don't need to worry about partial updates.
+//
+// The backend is picked with the storage.backend setting:
+//
+//	sqlite  inline in the harmony database (default)
+//	fs      files under storage.dir (default blobs in the data directory)
+//	s3      objects in storage.s3.bucket on an S3-compatible service at
+//	        storage.s3.endpoint, with the rest of the storage.s3 settings
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"harmony/backend/config"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// Store holds payloads by key.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	// Get fails with ErrNotFound when there's nothing under key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete succeeds when there's nothing under key.
+	Delete(ctx context.Context, key string) error
+}
+
+var ErrNotFound = errors.New("payload not found")
+
+var store Store
+
+// keys are slash-separated, so backends can lay them out as paths
+var keyRegex = regexp.MustCompile(`^[a-zA-Z0-9-]+(/[a-zA-Z0-9-]+)*$`)
+
+// BlobKey is the key a user's blob with the given hash is stored under.
+func BlobKey(userid string, hash string) string {
+	return userid + "/" + hash
+}
+
+// ChunkKey is the key chunk i of an upload is stored under until the
+// upload is finalized.
+func ChunkKey(uploadid string, i int64) string {
+	return "upload/" + uploadid + "/" + strconv.FormatInt(i, 10)
+}
+
+func checkKey(key string) error {
+	if !keyRegex.MatchString(key) {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	return nil
+}
+
+func Put(ctx context.Context, key string, data []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return store.Put(ctx, key, data)
+}
+
+func Get(ctx context.Context, key string) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return store.Get(ctx, key)
+}
+
+func Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
+
+// streamer is a Store that can take in a payload as it's read, rather than
+// all at once.
+type streamer interface {
+	PutStream(ctx context.Context, key string, r io.Reader, size int64) error
+}
+
+// PutStream stores the size bytes r reads under key. Backends that keep
+// payloads as single values, like sqlite, read all of it first; the others
+// only ever hold part of it in memory.
+func PutStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if s, ok := store.(streamer); ok {
+		return s.PutStream(ctx, key, r, size)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, key, data)
+}
+
+// PutTx is Put for a payload stored as part of the database transaction
+// tx. The sqlite backend writes it in tx, so it's rolled back along with
+// it; the others write it right away.
+func PutTx(ctx context.Context, tx *sql.Tx, key string, data []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if _, ok := store.(*SQLiteStore); ok {
+		return put(ctx, tx, key, data)
+	}
+	return store.Put(ctx, key, data)
+}
+
+// InDatabase reports whether payloads are kept in the database.
+func InDatabase() bool {
+	_, ok := store.(*SQLiteStore)
+	return ok
+}
+
+// SetStore makes s the backend payloads are kept in, in place of the
+// configured one.
+func SetStore(s Store) {
+	store = s
+}
+
+// Setup opens the configured backend. The sqlite backend needs the database
+// to be open first.
+func Setup(cfg config.Storage) error {
+	var err error
+
+	switch kind := cfg.Backend; kind {
+	case "sqlite":
+		store = NewSQLiteStore()
+	case "fs":
+		store, err = NewFSStore(cfg.Dir)
+	case "s3":
+		store, err = NewS3Store(S3Config(cfg.S3))
+	default:
+		return fmt.Errorf("unknown storage backend %q", kind)
+	}
+
+	return err
+}
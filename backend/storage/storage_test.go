@@ -0,0 +1,147 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"harmony/backend/common"
+	"harmony/backend/db"
+	"harmony/backend/storage"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// useStore makes s the backend payloads are kept in until the test is
+// done.
+func useStore(t *testing.T, s storage.Store) {
+	prev := storage.CurrentStore()
+	storage.SetStore(s)
+	t.Cleanup(func() { storage.SetStore(prev) })
+}
+
+// testStore checks s against what the Store interface promises.
+func testStore(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	key := storage.BlobKey("user", "0123abcd")
+
+	if _, err := s.Get(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Get before Put: got error %v, want ErrNotFound", err)
+	}
+
+	if err := s.Put(ctx, key, []byte("first")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if data, err := s.Get(ctx, key); err != nil || !bytes.Equal(data, []byte("first")) {
+		t.Fatalf("Get after Put: got %q, %v", data, err)
+	}
+
+	if err := s.Put(ctx, key, []byte("second")); err != nil {
+		t.Fatalf("Put again: %v", err)
+	}
+	if data, err := s.Get(ctx, key); err != nil || !bytes.Equal(data, []byte("second")) {
+		t.Fatalf("Get after second Put: got %q, %v", data, err)
+	}
+
+	if err := s.Put(ctx, storage.BlobKey("user", "empty"), []byte{}); err != nil {
+		t.Fatalf("Put empty: %v", err)
+	}
+	if data, err := s.Get(ctx, storage.BlobKey("user", "empty")); err != nil || len(data) != 0 {
+		t.Fatalf("Get empty: got %q, %v", data, err)
+	}
+
+	// whether or not the backend streams, PutStream stores size bytes
+	useStore(t, s)
+	if err := storage.PutStream(ctx, key, strings.NewReader("streamed and then some"), 8); err != nil {
+		t.Fatalf("PutStream: %v", err)
+	}
+	if data, err := s.Get(ctx, key); err != nil || !bytes.Equal(data, []byte("streamed")) {
+		t.Fatalf("Get after PutStream: got %q, %v", data, err)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Get after Delete: got error %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete of a missing key: %v", err)
+	}
+}
+
+func TestFSStore(t *testing.T) {
+	s, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+// TestSQLiteStore runs against a database set up the way the server sets
+// up its own, migrations and all.
+func TestSQLiteStore(t *testing.T) {
+	dataDir, prevDb := common.DataDir, common.Db
+	t.Cleanup(func() { common.DataDir, common.Db = dataDir, prevDb })
+
+	common.DataDir = t.TempDir()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s := storage.NewSQLiteStore()
+	useStore(t, s)
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, s)
+}
+
+func TestS3Store(t *testing.T) {
+	srv := newFakeS3()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := storage.NewS3Store(storage.S3Config{
+		Endpoint:  u.Host,
+		Bucket:    "harmony",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Region:    "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store: %v", err)
+	}
+	testStore(t, s)
+}
+
+func TestCheckKey(t *testing.T) {
+	s, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStore(t, s)
+	ctx := context.Background()
+
+	for _, key := range []string{"", "/abs", "a//b", "a/../b", "a/b/", "a b", `a\b`} {
+		if err := storage.Put(ctx, key, []byte("x")); err == nil {
+			t.Errorf("Put(%q) succeeded, want an invalid key error", key)
+		}
+		if _, err := storage.Get(ctx, key); err == nil || errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Get(%q): got error %v, want an invalid key error", key, err)
+		}
+		if err := storage.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded, want an invalid key error", key)
+		}
+	}
+
+	if err := storage.Put(ctx, storage.BlobKey("user-1", "abc123"), []byte("x")); err != nil {
+		t.Errorf("Put with a valid key: %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package utils
+
+import "errors"
+
+// FreeSpace isn't supported off Unix.
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package utils
+
+import "syscall"
+
+// FreeSpace returns how many bytes unprivileged users may still write to
+// the filesystem path is on.
+func FreeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
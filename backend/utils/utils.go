@@ -1,15 +1,20 @@
 package utils
 
 import (
-	"encoding/base64"
 	"fmt"
 	"maps"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
+// signingKey signs and verifies access tokens.
+var signingKey []byte
+
+func SetSigningKey(key []byte) {
+	signingKey = key
+}
+
 func GenerateAccessToken(payload map[string]any, expirationTime time.Duration) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 
@@ -20,12 +25,7 @@ func GenerateAccessToken(payload map[string]any, expirationTime time.Duration) (
 	claims["exp"] = t.Add(expirationTime).Unix()
 	claims["iat"] = t.Unix()
 
-	decodedKey, err := base64.StdEncoding.DecodeString(os.Getenv("JWT_SK"))
-	if err != nil {
-		return "", fmt.Errorf("[error] decoding signing key: %v", err)
-	}
-
-	tokenString, err := token.SignedString(decodedKey)
+	tokenString, err := token.SignedString(signingKey)
 	if err != nil {
 		return "", err
 	}
@@ -39,11 +39,7 @@ func VerifyAndDecodeToken(tokenString string) (map[string]any, error) {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		decodedKey, err := base64.StdEncoding.DecodeString(os.Getenv("JWT_SK"))
-		if err != nil {
-			return "", fmt.Errorf("[error] decoding signing key: %v", err)
-		}
-		return decodedKey, nil
+		return signingKey, nil
 	})
 	if err != nil {
 		return nil, err
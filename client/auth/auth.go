@@ -14,16 +14,16 @@ import (
 	"os/exec"
 	"runtime"
 	"slices"
-	"sort"
+	"strings"
 	"time"
 )
 
 const (
-	clientID       = "Iv23lixNQQwpjTJDJGf5"
-	deviceAuthURL  = "https://github.com/login/device/code"
-	githubEmailAPI = "https://api.github.com/user/emails"
-	pollInterval   = 5 * time.Second
-	tokenURL       = "https://github.com/login/oauth/access_token"
+	clientID      = "Iv23lixNQQwpjTJDJGf5"
+	deviceFile    = "device_id"
+	deviceAuthURL = "https://github.com/login/device/code"
+	pollInterval  = 5 * time.Second
+	tokenURL      = "https://github.com/login/oauth/access_token"
 )
 
 type DeviceAuthResponse struct {
@@ -34,13 +34,6 @@ type DeviceAuthResponse struct {
 	Interval        int    `json:"interval"`
 }
 
-type Email struct {
-	Email      string `json:"email"`
-	Verified   bool   `json:"verified"`
-	Primary    bool   `json:"primary"`
-	Visibility string `json:"visibility"`
-}
-
 func openBrowser(url string) error {
 	var cmd string
 	var args []string
@@ -144,60 +137,63 @@ func getAccessToken() (string, error) {
 	return token, nil
 }
 
-func GetEmail() (string, error) {
-	token, err := getAccessToken()
-	if err != nil {
-		return "", err
-	}
-
-	req, err := http.NewRequest("GET", githubEmailAPI, nil)
+// loadDeviceId returns the id this device was registered with, if any.
+func loadDeviceId() string {
+	data, err := os.ReadFile(deviceFile)
 	if err != nil {
-		return "", err
+		return ""
 	}
-	req.Header.Set("Accept", "application/vnd.github+json")
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	return strings.TrimSpace(string(data))
+}
 
-	resp, err := common.Client.Do(req)
+// createSession signs the device in with an OAuth access token, from which
+// the server finds out who the user is. The server registers the device, or
+// recognizes it by the id it was given last time.
+func createSession(token string) error {
+	name, err := os.Hostname()
 	if err != nil {
-		return "", err
+		name = runtime.GOOS
 	}
-	defer resp.Body.Close()
 
-	var emails []Email
-	if err := json.NewDecoder(resp.Body).Decode(&emails); err != nil {
-		return "", err
+	q := url.Values{}
+	q.Set("device", name)
+	if id := loadDeviceId(); id != "" {
+		q.Set("device_id", id)
 	}
 
-	if len(emails) == 0 {
-		return "", fmt.Errorf("no emails found")
+	req, err := http.NewRequest("GET", common.Host+"/user?"+q.Encode(), nil)
+	if err != nil {
+		return err
 	}
+	req.Header.Set("Authorization", "Bearer "+token)
 
-	sort.Slice(emails, func(i, j int) bool {
-		return emails[i].Email < emails[j].Email
-	})
-
-	return emails[0].Email, nil
-}
-
-func SignIn() error {
-	email, err := GetEmail()
+	res, err := common.Client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	req, err := http.NewRequest("GET", common.Host+"/user?email="+email, nil)
-	if err != nil {
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("[error] signing in: %s", res.Status)
+	}
+
+	var body struct {
+		DeviceId string `json:"device_id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
 		return err
 	}
 
-	res, err := common.Client.Do(req)
+	return os.WriteFile(deviceFile, []byte(body.DeviceId), 0600)
+}
+
+func SignIn() error {
+	token, err := getAccessToken()
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
 
-	return nil
+	return createSession(token)
 }
 
 func checkSession() (bool, error) {
@@ -215,35 +211,58 @@ func checkSession() (bool, error) {
 	return res.StatusCode == http.StatusOK, nil
 }
 
+// refreshSession gets the device a new access token, signing in again only
+// when the session can't be refreshed.
 func refreshSession() error {
-	email, err := GetEmail()
+	ok, err := tryRefresh()
 	if err != nil {
 		return err
 	}
-
-	req, err := http.NewRequest("GET", common.Host+"/user?email="+email, nil)
-	if err != nil {
-		return err
+	if ok {
+		return nil
 	}
 
-	res, err := common.Client.Do(req)
+	token, err := getAccessToken()
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
 
-	return nil
+	return createSession(token)
 }
 
+// cookiePaths are where the server scopes its cookies. The jar only hands
+// out a cookie for URLs under its path, so each has to be asked for.
+var cookiePaths = []string{"/", "/session"}
+
+// SaveCookies writes the session's cookies to disk, each with the path it
+// was set for so that loadCookies puts it back under the same one.
 func SaveCookies() error {
+	var cookies []*http.Cookie
+	seen := make(map[string]bool)
+	for _, path := range cookiePaths {
+		u, err := url.Parse(common.Host + path)
+		if err != nil {
+			return err
+		}
+
+		// the jar doesn't say which path a cookie was set for, but those
+		// it returns for the first path they match were set for that one
+		for _, cookie := range common.Client.Jar.Cookies(u) {
+			if seen[cookie.Name] {
+				continue
+			}
+			seen[cookie.Name] = true
+			cookie.Path = path
+			cookies = append(cookies, cookie)
+		}
+	}
+
 	file, err := os.Create("cookies.json")
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	url, _ := url.Parse(common.Host)
-	cookies := common.Client.Jar.Cookies(url)
 	encoder := json.NewEncoder(file)
 	if err := encoder.Encode(cookies); err != nil {
 		return err
@@ -252,7 +271,9 @@ func SaveCookies() error {
 	return nil
 }
 
-func CreateOrRestoreCookies() (bool, error) {
+// loadCookies restores the cookies saved last time, reporting whether there
+// were any.
+func loadCookies() (bool, error) {
 	file, err := os.Open("cookies.json")
 	if err != nil {
 		file, err = os.Create("cookies.json")
@@ -275,6 +296,15 @@ func CreateOrRestoreCookies() (bool, error) {
 		common.Client.Jar.SetCookies(url, []*http.Cookie{cookie})
 	}
 
+	return true, nil
+}
+
+func CreateOrRestoreCookies() (bool, error) {
+	ok, err := loadCookies()
+	if !ok || err != nil {
+		return ok, err
+	}
+
 	session, err := checkSession()
 	if err != nil {
 		return false, err
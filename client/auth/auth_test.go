@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"harmony/client/common"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// useCookieDir runs the test in its own directory, where cookies.json is
+// kept, with a fresh cookie jar.
+func useCookieDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	client, host := common.Client, common.Host
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		common.Client, common.Host = client, host
+	})
+
+	common.Host = "http://harmony.test"
+	newJar(t)
+}
+
+func newJar(t *testing.T) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	common.Client = &http.Client{Jar: jar}
+}
+
+func cookieNames(t *testing.T, path string) map[string]string {
+	u, err := url.Parse(common.Host + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]string)
+	for _, c := range common.Client.Jar.Cookies(u) {
+		names[c.Name] = c.Value
+	}
+	return names
+}
+
+func TestSaveCookiesKeepsPaths(t *testing.T) {
+	useCookieDir(t)
+
+	// as the server sets them when signing in
+	u, _ := url.Parse(common.Host + "/user")
+	common.Client.Jar.SetCookies(u, []*http.Cookie{
+		{Name: "access_token", Value: "access", Path: "/", HttpOnly: true},
+		{Name: "refresh_token", Value: "refresh", Path: "/session", HttpOnly: true},
+	})
+
+	if err := SaveCookies(); err != nil {
+		t.Fatalf("SaveCookies: %v", err)
+	}
+
+	newJar(t)
+	ok, err := loadCookies()
+	if err != nil || !ok {
+		t.Fatalf("loadCookies: got %v, %v", ok, err)
+	}
+
+	got := cookieNames(t, "/buffer")
+	if len(got) != 1 || got["access_token"] != "access" {
+		t.Errorf("cookies sent to /buffer: got %v, want only the access token", got)
+	}
+
+	got = cookieNames(t, "/session/refresh")
+	if len(got) != 2 || got["access_token"] != "access" || got["refresh_token"] != "refresh" {
+		t.Errorf("cookies sent to /session/refresh: got %v, want both tokens", got)
+	}
+}
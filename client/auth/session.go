@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"harmony/client/common"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// renewMu makes sure only one request at a time renews the session. The
+// server revokes a session when its refresh token is used twice, so two
+// requests racing to refresh would sign the device out.
+var renewMu sync.Mutex
+
+// tryRefresh trades the refresh token for a new access token, and reports
+// whether the server accepted it.
+func tryRefresh() (bool, error) {
+	req, err := http.NewRequest("POST", common.Host+"/session/refresh", nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := common.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode == http.StatusNoContent, nil
+}
+
+func accessToken(cookies []*http.Cookie) string {
+	for _, c := range cookies {
+		if c.Name == "access_token" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// renewSession gets a new access token to replace the one a request was
+// turned away with, unless another request already did.
+func renewSession(rejected string) error {
+	renewMu.Lock()
+	defer renewMu.Unlock()
+
+	u, err := url.Parse(common.Host)
+	if err != nil {
+		return err
+	}
+	if accessToken(common.Client.Jar.Cookies(u)) != rejected {
+		return nil
+	}
+
+	if err := refreshSession(); err != nil {
+		return err
+	}
+	return SaveCookies()
+}
+
+// refreshTransport renews the session when the server turns a request away
+// because the access token expired, then sends the request again.
+type refreshTransport struct {
+	base http.RoundTripper
+}
+
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	return &refreshTransport{base: base}
+}
+
+func (t *refreshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	// only our own server's session can be renewed, and not while signing in
+	path, ok := strings.CutPrefix(req.URL.String(), common.Host)
+	if !ok || path == "/user" || strings.HasPrefix(path, "/user?") || strings.HasPrefix(path, "/session/") {
+		return res, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+
+	var rejected string
+	if c, err := req.Cookie("access_token"); err == nil {
+		rejected = c.Value
+	}
+	if err := renewSession(rejected); err != nil {
+		log.Println("[error] renewing session:", err)
+		return res, nil
+	}
+	res.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Del("Cookie")
+	for _, c := range common.Client.Jar.Cookies(req.URL) {
+		retry.AddCookie(c)
+	}
+
+	return t.base.RoundTrip(retry)
+}
+
+// Logout revokes this device's session on the server and forgets it.
+func Logout() error {
+	if _, err := loadCookies(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", common.Host+"/session/logout", nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := common.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("[error] logging out: %s", res.Status)
+	}
+
+	return SaveCookies()
+}
+
+// PinCertificate pins the client certificate this device connects with to
+// it on the server, which then signs the device in whenever it presents
+// the certificate. It returns the certificate's fingerprint.
+func PinCertificate() (string, error) {
+	signedIn, err := CreateOrRestoreCookies()
+	if err != nil {
+		return "", err
+	}
+	did := loadDeviceId()
+	if !signedIn || did == "" {
+		return "", errors.New("[error] sign this device in before pinning a certificate")
+	}
+
+	req, err := http.NewRequest("PUT", common.Host+"/devices/"+did+"/certificate", nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := common.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return "", fmt.Errorf("[error] pinning certificate: %s %s", res.Status, msg)
+	}
+
+	var body struct {
+		CertFingerprint string `json:"cert_fingerprint"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	if err := SaveCookies(); err != nil {
+		return "", err
+	}
+	return body.CertFingerprint, nil
+}
@@ -3,102 +3,250 @@ package clip
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"harmony/client/common"
+	"harmony/client/crypt"
 	"harmony/client/notify"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"golang.design/x/clipboard"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
 )
 
-const MaxBufferSize = 1024 * 1024 * 16 // bytes
+const (
+	MaxBufferSize = 1024 * 1024 * 100 // bytes
+	// clips larger than this are sent through a resumable chunked upload
+	chunkedUploadSize = 1024 * 1024 * 4 // bytes
+	// how many times a clip is sent again after the server rate limited it
+	rateLimitRetries = 3
+)
 
-func checkFileUrl(data []byte) ([]byte, bool) {
-	filePath := strings.TrimPrefix(string(data), "file://")
+// checkFileUrl turns a copied path to an image file into the image itself.
+// Other file URLs are sent as a URI list.
+func checkFileUrl(data []byte) ([]byte, common.BufType) {
+	filePath, isUrl := strings.CutPrefix(string(data), "file://")
 
 	// use regex to check if the file path is valid
 	rgx := regexp.MustCompile(`^/(?:[a-zA-Z0-9._\-\ \(\)\[\]]+/)*[a-zA-Z0-9._\-\ \(\)\[\]]*$`)
 	if !rgx.MatchString(filePath) {
-		return data, false
+		return data, common.TextType
 	}
 
 	// Check if file exists
 	_, err := os.Stat(filePath)
 	if err != nil {
 		log.Println("[error]", err)
-		return data, false
+		return data, common.TextType
+	}
+
+	fallback := common.TextType
+	if isUrl {
+		fallback = common.URIListType
+	}
+
+	// checking the file type
+	t := mime.TypeByExtension(strings.ToLower(filepath.Ext(filePath)))
+	if !isImage(common.BufType(t)) {
+		return data, fallback
 	}
 
 	// Read the file into a buffer
 	fileData, err := os.ReadFile(filePath)
 	if err != nil {
 		notify.NotifyText(fmt.Sprintf("🚫 Failed to read file: %s", err))
-		return data, false
+		return data, fallback
 	}
 
-	// checking the file type
-	extension := filepath.Ext(filePath)
-	if extension == ".png" || extension == ".jpg" || extension == ".jpeg" || extension == ".gif" {
-		return fileData, true
+	return fileData, common.BufType(t)
+}
+
+func isImage(t common.BufType) bool {
+	return strings.HasPrefix(string(t), "image/")
+}
+
+func isText(t common.BufType) bool {
+	return strings.HasPrefix(string(t), "text/")
+}
+
+// toPNG converts an image to PNG, the only image format the clipboard takes.
+func toPNG(data []byte) ([]byte, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
 	}
-	return data, false
+	if format == "png" {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func sendData(data []byte, t common.BufType) error {
-	if len(data) >= MaxBufferSize {
-		notify.NotifyText("🚫 Copied data should be within 300KB.\nPlease try again.")
-		return fmt.Errorf("buffer limit exceeded: %d bytes", len(data))
+// hasBlob asks the server whether it already stores a payload.
+func hasBlob(hash string) bool {
+	req, err := http.NewRequest("HEAD", common.Host+"/blob/"+hash, nil)
+	if err != nil {
+		return false
 	}
 
-	url := common.Host + "/clip/" + string(t)
+	res, err := common.Client.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
 
-	var ct string
-	if t == common.ImageType {
-		ct = "application/octet-stream"
-	} else {
-		ct = "text/plain"
+	return res.StatusCode == http.StatusOK
+}
+
+// postClip sends a clip. sealed may be nil when the server already has a
+// payload with the given hash.
+func postClip(sealed []byte, hash string, t common.BufType) (*http.Response, error) {
+	req, err := http.NewRequest("POST", common.Host+"/clip", bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Buffer-Type", string(t))
+	req.Header.Set("X-Buffer-Hash", hash)
+	req.Header.Set("X-Buffer-Encryption", crypt.Scheme)
+	if common.Lifetime != 0 {
+		req.Header.Set("X-Buffer-Lifetime", strconv.FormatInt(int64(common.Lifetime.Seconds()), 10))
+	}
+
+	return common.Client.Do(req)
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+func sendData(data []byte, t common.BufType) error {
+	if len(data) >= MaxBufferSize {
+		notify.NotifyText(fmt.Sprintf("🚫 Copied data should be within %dMB.\nPlease try again.", MaxBufferSize/1024/1024))
+		return fmt.Errorf("buffer limit exceeded: %d bytes", len(data))
+	}
+
+	// the server only ever sees ciphertext, whatever the clip's type
+	sealed, err := crypt.Encrypt(data, string(t))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", ct)
 
-	res, err := common.Client.Do(req)
+	// encryption is deterministic, so a clip copied again or synced back
+	// from another device hashes the same and needn't be sent again
+	sum := sha256.Sum256(sealed)
+	hash := hex.EncodeToString(sum[:])
+
+	var res *http.Response
+	for attempt := 0; ; attempt++ {
+		res, err = sendSealed(sealed, hash, t)
+		var rl *common.RateLimitError
+		if !errors.As(err, &rl) || attempt == rateLimitRetries {
+			break
+		}
+		log.Printf("[error] sending clip: %v\n", rl)
+		time.Sleep(rl.RetryAfter)
+	}
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	buf, _ := io.ReadAll(res.Body)
-	ttl_ := string(buf)
-	ttl, _ := strconv.ParseInt(ttl_, 10, 64)
+	if res.StatusCode == http.StatusInsufficientStorage {
+		buf, _ := io.ReadAll(res.Body)
+		notify.NotifyText(fmt.Sprintf("🚫 Clip not synced, your %s.", string(buf)))
+		return fmt.Errorf("over quota: %s", string(buf))
+	} else if res.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected response: %s", string(buf))
+	}
+
+	v := res.Header.Get("X-Buffer-Version")
+	version, _ := strconv.ParseInt(v, 10, 64)
 
-	common.LatestTTL = ttl
+	common.LatestVersion = version
 	common.LatestBuffer = data
 
 	return nil
 }
 
+// sendSealed sends an encrypted clip, as a reference to the payload if the
+// server already has it. A rate limited attempt returns a
+// *common.RateLimitError.
+func sendSealed(sealed []byte, hash string, t common.BufType) (*http.Response, error) {
+	var res *http.Response
+	var err error
+	if hasBlob(hash) {
+		res, err = postClip(nil, hash, t)
+		if err == nil && res.StatusCode == http.StatusConflict {
+			// the server dropped the payload since we asked
+			res.Body.Close()
+			res = nil
+		}
+	}
+
+	if res == nil && err == nil {
+		if len(sealed) > chunkedUploadSize {
+			res, err = uploadChunked(sealed, t)
+		} else {
+			res, err = postClip(sealed, hash, t)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := common.CheckRateLimit(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// CopyToClipboard puts a clip on the clipboard. The clipboard only knows
+// plain text and PNG images, so any text format is written as text and
+// other images are converted.
 func CopyToClipboard(t common.BufType, data []byte, ntf bool) {
-	if t == common.TextType {
+	switch {
+	case isText(t):
 		clipboard.Write(clipboard.FmtText, data)
 		if ntf {
 			notify.NotifyText("⬇️ " + string(data))
 		}
-	} else {
-		clipboard.Write(clipboard.FmtImage, data)
+	case isImage(t):
+		img, err := toPNG(data)
+		if err != nil {
+			log.Println("[error] converting image:", err)
+			return
+		}
+
+		clipboard.Write(clipboard.FmtImage, img)
 		if ntf {
-			notify.NotifyImage("⬇️ Image", data)
+			notify.NotifyImage("⬇️ Image", img)
+		}
+	default:
+		log.Printf("[error] can't copy clips of type %s\n", t)
+		if ntf {
+			notify.NotifyText(fmt.Sprintf("🚫 Received a clip of unsupported type %s", t))
 		}
 	}
 }
@@ -107,20 +255,22 @@ func watchText(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	ch := clipboard.Watch(ctx, clipboard.FmtText)
 	for data := range ch {
-		data, isFile := checkFileUrl(data)
-		if isFile {
-			err := sendData(data, common.ImageType)
-			if err != nil {
-				log.Println("[error]", err)
-				continue
-			}
+		// skip clips we just received from the server, so they aren't
+		// echoed back into the history as new entries
+		if bytes.Equal(data, common.LatestBuffer) {
+			continue
+		}
+
+		data, t := checkFileUrl(data)
+		err := sendData(data, t)
+		if err != nil {
+			log.Println("[error]", err)
+			continue
+		}
+
+		if isImage(t) {
 			notify.NotifyImage("⬆️ Image", data)
 		} else {
-			err := sendData(data, common.TextType)
-			if err != nil {
-				log.Println("[error]", err)
-				continue
-			}
 			notify.NotifyText("⬆️ " + string(data))
 		}
 
@@ -131,6 +281,10 @@ func watchImage(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	ch := clipboard.Watch(ctx, clipboard.FmtImage)
 	for data := range ch {
+		if bytes.Equal(data, common.LatestBuffer) {
+			continue
+		}
+
 		err := sendData(data, common.ImageType)
 		if err != nil {
 			log.Println("[error]", err)
@@ -151,10 +305,115 @@ func Watch() {
 	wg.Wait()
 }
 
+type pushedClip struct {
+	Id         string         `json:"id"`
+	Type       common.BufType `json:"type"`
+	Encryption string         `json:"encryption"`
+	Time       int64          `json:"time"`
+	Version    int64          `json:"version"`
+	Data       []byte         `json:"data"`
+}
+
+// version is the buffer version the clip brought, which servers that don't
+// send one took to be the clip's time.
+func (c *pushedClip) version() int64 {
+	if c.Version != 0 {
+		return c.Version
+	}
+	return c.Time
+}
+
+// receive copies a clip from the server to the clipboard, unless it's what we
+// already have.
+func receive(t common.BufType, enc string, data []byte, version int64) {
+	common.LatestVersion = version
+
+	if enc != "" {
+		plain, err := crypt.Decrypt(data, string(t), enc)
+		if err != nil {
+			log.Println("[error] decrypting clip:", err)
+			notify.NotifyText("🚫 Received a clip this device can't decrypt.\nImport the key from your other devices with -import-key.")
+			return
+		}
+		data = plain
+	}
+
+	// our own clips come back to us as well
+	if bytes.Equal(data, common.LatestBuffer) {
+		return
+	}
+
+	common.LatestBuffer = data
+	CopyToClipboard(t, data, true)
+}
+
+// Listen receives clips pushed by the server over a WebSocket and copies them
+// to the clipboard. It blocks until the connection is lost, and returns an
+// error right away when the socket cannot be established, so the caller can
+// fall back to polling with GetBuffer.
+func Listen() error {
+	u, err := url.Parse(common.Host + "/ws")
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+
+	dialer := websocket.Dialer{
+		Jar:              common.Client.Jar,
+		TLSClientConfig:  common.TLSConfig,
+		HandshakeTimeout: 10 * time.Second,
+	}
+
+	conn, _, err := dialer.DialContext(common.Ctx, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("connecting websocket: %w", err)
+	}
+	defer conn.Close()
+
+	// catch up on anything copied while we were disconnected
+	if err := GetBuffer(); err != nil {
+		log.Println("[error]", err)
+	}
+
+	for {
+		var c pushedClip
+		if err := conn.ReadJSON(&c); err != nil {
+			return fmt.Errorf("reading websocket: %w", err)
+		}
+
+		receive(c.Type, c.Encryption, c.Data, c.version())
+	}
+}
+
+// receiveBuffer handles a clip served by GET /buffer or GET /buffer/:id.
+func receiveBuffer(res *http.Response) {
+	bt := common.BufType(res.Header.Get("Content-Type"))
+
+	data, _ := io.ReadAll(res.Body)
+	v := res.Header.Get("X-Buffer-Version")
+	version, _ := strconv.ParseInt(v, 10, 64)
+
+	receive(bt, res.Header.Get("X-Buffer-Encryption"), data, version)
+}
+
+// LongPoll is set once the server has announced long-polling support, after
+// which GetBuffer blocks on the server until there's a newer buffer instead
+// of returning right away.
+var LongPoll bool
+
+const longPollWait = 30 // seconds
+
 func GetBuffer() error {
 	url := common.Host + "/buffer"
-	if common.LatestTTL != 0 {
-		url += "?ttl=" + fmt.Sprintf("%d", common.LatestTTL)
+	if common.LatestVersion != 0 {
+		url += "?version=" + fmt.Sprintf("%d", common.LatestVersion)
+		if LongPoll {
+			url += "&wait=" + strconv.Itoa(longPollWait)
+		}
 	}
 
 	req, err := http.NewRequest("GET", url, nil)
@@ -168,20 +427,14 @@ func GetBuffer() error {
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode == http.StatusOK {
-		bt := common.TextType
-		if res.Header.Get("Content-Type") == "application/octet-stream" {
-			bt = common.ImageType
-		}
-
-		data, _ := io.ReadAll(res.Body)
-		t := res.Header.Get("X-Buffer-TTL")
-		ttl, _ := strconv.ParseInt(t, 10, 64)
+	if err := common.CheckRateLimit(res); err != nil {
+		return err
+	}
 
-		common.LatestTTL = ttl
-		common.LatestBuffer = data
-		CopyToClipboard(bt, data, true)
+	LongPoll = res.Header.Get("X-Buffer-Wait") != ""
 
+	if res.StatusCode == http.StatusOK {
+		receiveBuffer(res)
 	} else if res.StatusCode != http.StatusNotModified && res.StatusCode != http.StatusNoContent {
 		buf, _ := io.ReadAll(res.Body)
 		return fmt.Errorf("unexpected response: %s", string(buf))
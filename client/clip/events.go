@@ -0,0 +1,140 @@
+package clip
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"harmony/client/common"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// lastEventId is sent back on reconnect so the server only replays what we
+// missed.
+var lastEventId string
+
+type bufferEvent struct {
+	Id      string         `json:"id"`
+	Type    common.BufType `json:"type"`
+	Size    int64          `json:"size"`
+	Time    int64          `json:"time"`
+	Ttl     int64          `json:"ttl"`
+	Version int64          `json:"version"`
+}
+
+func getClip(id string) error {
+	req, err := http.NewRequest("GET", common.Host+"/buffer/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := common.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		receiveBuffer(res)
+	} else if res.StatusCode != http.StatusNotFound {
+		buf, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected response: %s", string(buf))
+	}
+
+	return nil
+}
+
+func handleEvent(event string, data string) error {
+	switch event {
+	case "clip":
+		var e bufferEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return err
+		}
+		// servers that don't send a version took it to be the clip's
+		// time, which clips sent within a second share
+		if e.Version != 0 && e.Version <= common.LatestVersion || e.Version == 0 && e.Time < common.LatestVersion {
+			return nil
+		}
+		return getClip(e.Id)
+	case "reset":
+		return GetBuffer()
+	}
+	return nil
+}
+
+// Stream consumes the server's Server-Sent Events feed of buffer changes and
+// copies new clips to the clipboard. It is an alternative to polling
+// GetBuffer for networks where WebSockets don't get through. It blocks until
+// the stream ends.
+func Stream() error {
+	req, err := http.NewRequestWithContext(common.Ctx, "GET", common.Host+"/buffer/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	res, err := common.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		buf, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected response: %s", string(buf))
+	}
+
+	// without an id to resume from, the server sends no backlog
+	if lastEventId == "" {
+		if err := GetBuffer(); err != nil {
+			log.Println("[error]", err)
+		}
+	}
+
+	var event, id string
+	var data []string
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if len(data) > 0 {
+				if err := handleEvent(event, strings.Join(data, "\n")); err != nil {
+					log.Println("[error]", err)
+				}
+			}
+			if id != "" {
+				lastEventId = id
+			}
+			event, id, data = "", "", nil
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "id":
+			id = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading event stream: %w", err)
+	}
+	return fmt.Errorf("event stream closed")
+}
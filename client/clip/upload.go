@@ -0,0 +1,173 @@
+package clip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"harmony/client/common"
+	"harmony/client/crypt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	chunkSize      = 1024 * 1024 * 2 // bytes
+	uploadAttempts = 5
+	uploadBackoff  = 2 * time.Second
+)
+
+type upload struct {
+	Id        string `json:"id"`
+	ChunkSize int64  `json:"chunk_size"`
+	Chunks    []struct {
+		Index    int64  `json:"index"`
+		Checksum string `json:"checksum"`
+	} `json:"chunks"`
+}
+
+func uploadRequest(method string, path string, body io.Reader, v any) error {
+	req, err := http.NewRequest(method, common.Host+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil && method == "POST" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := common.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := common.CheckRateLimit(res); err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		buf, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected response: %s", string(buf))
+	}
+
+	if v != nil {
+		return json.NewDecoder(res.Body).Decode(v)
+	}
+	return nil
+}
+
+func putChunk(id string, index int64, chunk []byte, checksum string) error {
+	url := common.Host + "/uploads/" + id + "/chunks/" + strconv.FormatInt(index, 10)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Chunk-Checksum", checksum)
+
+	res, err := common.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := common.CheckRateLimit(res); err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("unexpected response: %s", string(buf))
+	}
+	return nil
+}
+
+// sendChunks uploads every chunk the server doesn't have an intact copy of.
+func sendChunks(u *upload, sealed []byte) error {
+	have := make(map[int64]string)
+	for _, ch := range u.Chunks {
+		have[ch.Index] = ch.Checksum
+	}
+
+	for i := int64(0); i*u.ChunkSize < int64(len(sealed)); i++ {
+		chunk := sealed[i*u.ChunkSize : min(int64(len(sealed)), (i+1)*u.ChunkSize)]
+		sum := sha256.Sum256(chunk)
+		checksum := hex.EncodeToString(sum[:])
+
+		if have[i] == checksum {
+			continue
+		}
+		if err := putChunk(u.Id, i, chunk, checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadChunked sends a large clip through an upload session. Whenever a
+// step fails it asks the server which chunks made it and carries on from
+// there, rather than starting over. It returns the response to the final
+// request, which the server answers just like a regular clip upload.
+func uploadChunked(sealed []byte, t common.BufType) (*http.Response, error) {
+	body, _ := json.Marshal(map[string]any{
+		"type":       t,
+		"encryption": crypt.Scheme,
+		"lifetime":   int64(common.Lifetime.Seconds()),
+		"size":       len(sealed),
+		"chunk_size": chunkSize,
+	})
+
+	var u upload
+	if err := uploadRequest("POST", "/uploads", bytes.NewReader(body), &u); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for attempt := 0; attempt < uploadAttempts; attempt++ {
+		if attempt > 0 {
+			log.Printf("[error] upload %s: %v, retrying\n", u.Id, err)
+			wait := uploadBackoff * time.Duration(attempt)
+			var rl *common.RateLimitError
+			if errors.As(err, &rl) {
+				wait = max(wait, rl.RetryAfter)
+			}
+			time.Sleep(wait)
+
+			if err = uploadRequest("GET", "/uploads/"+u.Id, nil, &u); err != nil {
+				continue
+			}
+		}
+
+		if err = sendChunks(&u, sealed); err != nil {
+			continue
+		}
+
+		req, rerr := http.NewRequest("POST", common.Host+"/uploads/"+u.Id+"/finalize", nil)
+		if rerr != nil {
+			return nil, rerr
+		}
+
+		var res *http.Response
+		res, err = common.Client.Do(req)
+		if err != nil {
+			continue
+		}
+		if res.StatusCode == http.StatusConflict {
+			res.Body.Close()
+			err = fmt.Errorf("server is missing chunks")
+			continue
+		}
+		if err = common.CheckRateLimit(res); err != nil {
+			res.Body.Close()
+			continue
+		}
+		return res, nil
+	}
+
+	// let the server drop what it has so far rather than wait for cleanup
+	uploadRequest("DELETE", "/uploads/"+u.Id, nil, nil)
+	return nil, fmt.Errorf("uploading clip: %w", err)
+}
@@ -2,26 +2,66 @@ package common
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
-	Ctx          context.Context
-	Client       *http.Client
-	Host         string
-	LatestTTL    int64
-	LatestBuffer []byte
+	Ctx           context.Context
+	Client        *http.Client
+	Host          string
+	LatestVersion int64
+	LatestBuffer  []byte
+
+	// TLSConfig is what connections to the server are made with, so the
+	// WebSocket uses the same CA and client certificate as requests.
+	TLSConfig *tls.Config
+
+	// Lifetime is how long clips copied on this device are kept by the
+	// server. Zero leaves it to the user's default.
+	Lifetime time.Duration
 )
 
+// BufType is the MIME type of a clip's contents.
 type BufType string
 
 const (
-	TextType  BufType = "text"
-	ImageType BufType = "image"
+	TextType    BufType = "text/plain"
+	URIListType BufType = "text/uri-list"
+	ImageType   BufType = "image/png"
 )
 
+// RateLimitError is returned when the server turned a request away for
+// coming too fast.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, retry in %s", e.RetryAfter)
+}
+
+// CheckRateLimit returns a *RateLimitError with the wait the server asked
+// for in Retry-After if res is a 429.
+func CheckRateLimit(res *http.Response) error {
+	if res.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+
+	wait := time.Second
+	h := res.Header.Get("Retry-After")
+	if s, err := strconv.Atoi(h); err == nil && s > 0 {
+		wait = time.Duration(s) * time.Second
+	} else if t, err := http.ParseTime(h); err == nil && time.Until(t) > 0 {
+		wait = time.Until(t)
+	}
+	return &RateLimitError{RetryAfter: wait}
+}
+
 func ClearScreen() {
 	fmt.Fprint(os.Stdout, "\033[H\033[2J")
 }
@@ -0,0 +1,146 @@
+// Package crypt encrypts clips end-to-end, so the server only ever stores
+// ciphertext.
+//
+// All devices of a user share one AES-256 key, kept in harmony.key next to
+// cookies.json and never sent to the server. The first device to start
+// generates the key. To bring another device in, print the key by running
+// the client with -export-key on a device that already has it, then run the
+// client with -import-key <key> on the new device before it copies anything.
+//
+// Treat the printed key like a password. A device holding a different key
+// can't read the other devices' clips and is told so when they arrive.
+//
+// Sealing is deterministic: the nonce is derived from the key, the clip's
+// type and its contents, so copying the same thing twice produces the same
+// ciphertext and the server can deduplicate payloads it can't read. The
+// server learns that two clips are equal, and nothing else.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// Scheme names the encryption in the X-Buffer-Encryption header.
+	Scheme = "aes-256-gcm"
+
+	keyFile = "harmony.key"
+	keySize = 32
+)
+
+var ErrUnknownScheme = errors.New("unknown encryption scheme")
+
+var (
+	aead     cipher.AEAD
+	nonceKey []byte
+)
+
+func setKey(key []byte) error {
+	if len(key) != keySize {
+		return fmt.Errorf("key must be %d bytes, got %d", keySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("harmony nonce"))
+	nonceKey = mac.Sum(nil)
+	return nil
+}
+
+// LoadOrCreateKey loads the shared key, generating one if this is the first
+// device. It reports whether a new key was generated.
+func LoadOrCreateKey() (bool, error) {
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return false, fmt.Errorf("reading %s: %w", keyFile, err)
+		}
+		return false, setKey(key)
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return false, err
+	}
+
+	if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		return false, err
+	}
+	return true, setKey(key)
+}
+
+// ExportKey returns the shared key in the form ImportKey accepts.
+func ExportKey() (string, error) {
+	if _, err := LoadOrCreateKey(); err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ImportKey replaces this device's key with one exported from another device.
+func ImportKey(encoded string) error {
+	encoded = strings.TrimSpace(encoded)
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid key: %w", err)
+	}
+
+	if err := setKey(key); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, []byte(encoded), 0600)
+}
+
+// Encrypt seals a clip. The clip's type is authenticated along with it, so
+// the server can't pass an image off as text or vice versa.
+func Encrypt(plaintext []byte, t string) ([]byte, error) {
+	// a nonce only repeats along with the exact same type and plaintext
+	mac := hmac.New(sha256.New, nonceKey)
+	binary.Write(mac, binary.BigEndian, uint32(len(t)))
+	mac.Write([]byte(t))
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	return aead.Seal(nonce, nonce, plaintext, []byte(t)), nil
+}
+
+// Decrypt opens a clip sealed by Encrypt on any of the user's devices.
+func Decrypt(ciphertext []byte, t string, scheme string) ([]byte, error) {
+	if scheme != Scheme {
+		return nil, ErrUnknownScheme
+	}
+
+	n := aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return aead.Open(nil, ciphertext[:n], ciphertext[n:], []byte(t))
+}
@@ -8,13 +8,14 @@ require (
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
 	github.com/tadvi/systray v0.0.0-20190226123456-11a2b8fa57af // indirect
 	golang.org/x/exp v0.0.0-20190731235908-ec7cb31e5a56 // indirect
-	golang.org/x/image v0.6.0 // indirect
 	golang.org/x/mobile v0.0.0-20230301163155-e0f57694e12c // indirect
 )
 
 require (
 	github.com/0xAX/notificator v0.0.0-20220220101646-ee9b8921e557
 	github.com/gen2brain/beeep v0.0.0-20240516210008-9c006672e7f4
+	github.com/gorilla/websocket v1.5.3
 	golang.design/x/clipboard v0.7.0
+	golang.org/x/image v0.6.0
 	golang.org/x/sys v0.6.0 // indirect
 )
@@ -2,24 +2,95 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
 	"harmony/client/auth"
 	"harmony/client/clip"
 	"harmony/client/common"
+	"harmony/client/crypt"
 	"log"
 	"net/http"
 	"net/http/cookiejar"
+	"os"
+	"strings"
 	"time"
 
 	"golang.design/x/clipboard"
 )
 
-func setup() error {
-	common.Host = "http://localhost:6554"
+var (
+	server   = flag.String("server", "http://localhost:6554", "URL of the Harmony server")
+	caFile   = flag.String("ca", "", "PEM certificates to trust the server's certificate by, besides the system's")
+	certFile = flag.String("cert", "", "PEM client certificate to present to the server, along with -key")
+	keyFile  = flag.String("key", "", "PEM private key of the -cert client certificate")
+)
+
+// loadTLSConfig returns the TLS settings the -ca, -cert and -key flags ask
+// for, or nil for the defaults.
+func loadTLSConfig() (*tls.Config, error) {
+	if *caFile == "" && *certFile == "" && *keyFile == "" {
+		return nil, nil
+	}
+
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *caFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if *certFile != "" || *keyFile != "" {
+		if *certFile == "" || *keyFile == "" {
+			return nil, errors.New("-cert and -key must be given together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+func setupClient() error {
+	common.Host = strings.TrimSuffix(*server, "/")
 	common.Ctx = context.TODO()
 
+	tc, err := loadTLSConfig()
+	if err != nil {
+		return err
+	}
+	common.TLSConfig = tc
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tc
+
 	jar, _ := cookiejar.New(nil)
-	common.Client = &http.Client{Jar: jar}
+	common.Client = &http.Client{
+		Jar:       jar,
+		Transport: auth.NewTransport(transport),
+	}
+	return nil
+}
+
+func setup() error {
+	if err := setupClient(); err != nil {
+		return err
+	}
 
 	logged_in, err := auth.CreateOrRestoreCookies()
 	if err != nil {
@@ -41,10 +112,68 @@ func setup() error {
 		fmt.Println("You are already signed in!")
 	}
 
+	created, err := crypt.LoadOrCreateKey()
+	if err != nil {
+		return fmt.Errorf("failed to load encryption key: %w", err)
+	}
+	if created {
+		fmt.Println("Generated a new encryption key for your clips.")
+		fmt.Println("To sync with another device, run this client with -export-key here and -import-key <key> there.")
+	}
+
 	return nil
 }
 
 func main() {
+	exportKey := flag.Bool("export-key", false, "print the clip encryption key, to import it on another device")
+	importKey := flag.String("import-key", "", "use the clip encryption key exported from another device")
+	lifetime := flag.Duration("lifetime", 0, "how long the server keeps clips copied on this device (default: your account's setting)")
+	logout := flag.Bool("logout", false, "sign this device out")
+	pinCert := flag.Bool("pin-cert", false, "pin the -cert client certificate to this device, so presenting it signs the device in")
+	flag.Parse()
+
+	common.Lifetime = *lifetime
+
+	if *pinCert {
+		if err := setupClient(); err != nil {
+			log.Fatal("[error]", err)
+		}
+		fp, err := auth.PinCertificate()
+		if err != nil {
+			log.Fatal("[error]", err)
+		}
+		fmt.Println("Pinned client certificate", fp, "to this device.")
+		return
+	}
+
+	if *logout {
+		if err := setupClient(); err != nil {
+			log.Fatal("[error]", err)
+		}
+		if err := auth.Logout(); err != nil {
+			log.Fatal("[error]", err)
+		}
+		fmt.Println("Signed out.")
+		return
+	}
+
+	if *exportKey {
+		key, err := crypt.ExportKey()
+		if err != nil {
+			log.Fatal("[error]", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	if *importKey != "" {
+		err := crypt.ImportKey(*importKey)
+		if err != nil {
+			log.Fatal("[error]", err)
+		}
+		fmt.Println("Encryption key imported.")
+	}
+
 	err := setup()
 	if err != nil {
 		log.Fatal("[error]", err)
@@ -53,19 +182,38 @@ func main() {
 
 	go func() {
 		for {
-			err := clip.GetBuffer()
+			// Push over the WebSocket is the primary transport, with the
+			// event stream as a fallback for networks that break
+			// WebSockets. Each only returns once it is down or can't be
+			// established, in which case we poll until one can be brought
+			// back up.
+			err := clip.Listen()
+			if err != nil {
+				log.Println("[error]", err)
+			}
+
+			err = clip.Stream()
 			if err != nil {
 				log.Println("[error]", err)
-				return
+			}
+
+			pollErr := clip.GetBuffer()
+			if pollErr != nil {
+				log.Println("[error]", pollErr)
 			}
 
 			err = auth.SaveCookies()
 			if err != nil {
 				log.Println("[error]", err)
-				return
 			}
 
-			time.Sleep(5 * time.Second)
+			// a long-poll already waited on the server
+			var rl *common.RateLimitError
+			if errors.As(pollErr, &rl) {
+				time.Sleep(max(rl.RetryAfter, 5*time.Second))
+			} else if pollErr != nil || !clip.LongPoll || common.LatestVersion == 0 {
+				time.Sleep(5 * time.Second)
+			}
 		}
 	}()
 